@@ -0,0 +1,242 @@
+package dfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Chunkers split file data into content-defined (or fixed) chunks. A
+// chunk boundary may only depend on the bytes since the previous
+// boundary; rechunk() relies on this.
+type Chunker interface {
+	// returns len of next chunk
+	Next(buf []byte) int
+	Params() ChunkParams
+}
+
+// ChunkParams is recorded in the Head, so a store is always read back and
+// rechunked with the chunker it was written with.
+type ChunkParams struct {
+	Kind    string // "rk", "fastcdc" or "fixed"
+	Min     int
+	Target  int
+	Max     int
+	HashLen int    `json:",omitempty"` // rk window
+	Prime   uint64 `json:",omitempty"` // rk base
+}
+
+var DefaultChunkParams = ChunkParams{"rk", MINCHUNK, TARGETCHUNK, MAXCHUNK, HASHLEN, THE_PRIME}
+
+// chunker used for writes, set from the head by Init
+var chunker Chunker = newRKChunker(DefaultChunkParams)
+
+func (p ChunkParams) String() string {
+	switch p.Kind {
+	case "fixed":
+		return fmt.Sprintf("fixed:%d", p.Target)
+	case "rk":
+		return fmt.Sprintf("rk:%d,%d,%d,%d,%d", p.Min, p.Target, p.Max, p.HashLen, p.Prime)
+	}
+	return fmt.Sprintf("%s:%d,%d,%d", p.Kind, p.Min, p.Target, p.Max)
+}
+
+// Parses "kind[:min,target,max]", e.g. "fastcdc:16384,65536,262144".
+// "fixed:<size>" takes just the chunk size, "rk" may add the window
+// length and prime. Missing numbers keep their defaults.
+func ParseChunkParams(s string) (ChunkParams, error) {
+	p := DefaultChunkParams
+	kind, args := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, args = s[:i], s[i+1:]
+	}
+	p.Kind = kind
+
+	var nums []int
+	for _, f := range strings.Split(args, ",") {
+		if f == "" {
+			continue
+		}
+		v, err := strconv.Atoi(f)
+		if err != nil || v <= 0 {
+			return p, fmt.Errorf("bad chunker parameter %q in %q", f, s)
+		}
+		nums = append(nums, v)
+	}
+
+	switch kind {
+	case "fixed":
+		if len(nums) > 1 {
+			return p, fmt.Errorf("fixed chunker takes one size: %q", s)
+		}
+		if len(nums) == 1 {
+			p.Target = nums[0]
+		}
+		p.Min, p.Max = p.Target, p.Target
+		p.HashLen, p.Prime = 0, 0
+	case "rk", "fastcdc":
+		if len(nums) > 5 || (kind == "fastcdc" && len(nums) > 3) {
+			return p, fmt.Errorf("too many chunker parameters: %q", s)
+		}
+		fields := []*int{&p.Min, &p.Target, &p.Max, &p.HashLen}
+		for i, v := range nums {
+			if i < len(fields) {
+				*fields[i] = v
+			} else {
+				p.Prime = uint64(v)
+			}
+		}
+		if kind == "fastcdc" {
+			p.HashLen, p.Prime = 0, 0
+		}
+	default:
+		return p, fmt.Errorf("unknown chunker %q", kind)
+	}
+	_, err := NewChunker(p)
+	return p, err
+}
+
+func NewChunker(p ChunkParams) (Chunker, error) {
+	if p.Min <= 0 || p.Min > p.Target || p.Target > p.Max {
+		return nil, fmt.Errorf("chunk sizes must satisfy 0 < min <= target <= max: %s", p)
+	}
+	switch p.Kind {
+	case "rk":
+		if p.HashLen <= 0 || p.HashLen > p.Min || p.Prime == 0 {
+			return nil, fmt.Errorf("rk window must be in (0, min], prime nonzero: %s", p)
+		}
+		return newRKChunker(p), nil
+	case "fastcdc":
+		if p.Target < 16 {
+			return nil, fmt.Errorf("fastcdc target too small: %s", p)
+		}
+		return newGearChunker(p), nil
+	case "fixed":
+		return fixedChunker{p}, nil
+	}
+	return nil, fmt.Errorf("unknown chunker %q", p.Kind)
+}
+
+//=============================================================================
+// Rabin-Karp rolling hash over a HashLen window, cut where hash % Target
+// == 1.
+
+type rkChunker struct {
+	p     ChunkParams
+	saved [256]uint64
+}
+
+func newRKChunker(p ChunkParams) *rkChunker {
+	c := &rkChunker{p: p}
+	b_n := uint64(1)
+	for i := 0; i < (p.HashLen - 1); i++ {
+		b_n *= p.Prime
+	}
+	for i := uint64(0); i < 256; i++ {
+		c.saved[i] = i * b_n
+	}
+	return c
+}
+
+func (c *rkChunker) Params() ChunkParams { return c.p }
+
+func (c *rkChunker) Next(buf []byte) int {
+	var off uint64
+	var hash uint64
+	b := c.p.Prime
+	hashlen := uint64(c.p.HashLen)
+
+	for off = 0; off < hashlen && off < uint64(len(buf)); off++ {
+		hash = hash*b + uint64((buf[off]))
+	}
+
+	for off < uint64(len(buf)) {
+		hash = (hash-c.saved[buf[off-hashlen]])*b + uint64(buf[off])
+		off++
+
+		if (off >= uint64(c.p.Min) && ((hash % uint64(c.p.Target)) == 1)) || (off >= uint64(c.p.Max)) {
+			return int(off)
+		}
+	}
+	return int(off)
+}
+
+//=============================================================================
+// FastCDC: gear hash, skipping the first Min bytes, with normalized
+// chunking (a harder cut condition before Target, an easier one after).
+
+type gearChunker struct {
+	p            ChunkParams
+	maskS, maskL uint64
+}
+
+// deterministic, the table is part of the on-disk format
+var gear = func() (g [256]uint64) {
+	x := uint64(0x9E3779B97F4A7C15)
+	for i := range g {
+		// splitmix64
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		g[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+func newGearChunker(p ChunkParams) *gearChunker {
+	bits := uint(0)
+	for (1 << (bits + 1)) <= p.Target {
+		bits++
+	}
+	// test the high bits, which depend on the last 64 bytes
+	top := func(n uint) uint64 { return ^uint64(0) << (64 - n) }
+	return &gearChunker{p: p, maskS: top(bits + 2), maskL: top(bits - 2)}
+}
+
+func (c *gearChunker) Params() ChunkParams { return c.p }
+
+func (c *gearChunker) Next(buf []byte) int {
+	n := len(buf)
+	if n <= c.p.Min {
+		return n
+	}
+	if n > c.p.Max {
+		n = c.p.Max
+	}
+	normal := c.p.Target
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.p.Min
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[buf[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[buf[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+//=============================================================================
+
+type fixedChunker struct {
+	p ChunkParams
+}
+
+func (c fixedChunker) Params() ChunkParams { return c.p }
+
+func (c fixedChunker) Next(buf []byte) int {
+	if len(buf) < c.p.Target {
+		return len(buf)
+	}
+	return c.p.Target
+}
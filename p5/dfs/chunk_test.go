@@ -0,0 +1,138 @@
+package dfs
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// Where c cuts data, as offsets of chunk ends.
+func cuts(c Chunker, data []byte) (l []int) {
+	for off := 0; off < len(data); {
+		off += c.Next(data[off:])
+		l = append(l, off)
+	}
+	return l
+}
+
+// Cuts of b, the edited data, that chunking before the edit (cuts a, of
+// data that had shift bytes fewer from at on) doesn't account for, and
+// vice versa.
+func moved(a, b []int, at, shift int) (l []int) {
+	was := make(map[int]bool)
+	for _, x := range a {
+		if x > at {
+			x += shift
+		}
+		was[x] = true
+	}
+	for _, x := range b {
+		if !was[x] {
+			l = append(l, x)
+		}
+		delete(was, x)
+	}
+	for x := range was {
+		l = append(l, x)
+	}
+	return l
+}
+
+func TestChunkers(t *testing.T) {
+	data := noise(5, 512<<10)
+	for _, spec := range []string{"rk", "fastcdc:2048,8192,32768", "fixed:4096"} {
+		p, err := ParseChunkParams(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := NewChunker(p)
+		c2, _ := NewChunker(p)
+		a := cuts(c, data)
+		if len(a) < 16 {
+			t.Fatalf("%s: %d chunks", spec, len(a))
+		}
+		prev := 0
+		for i, x := range a[:len(a)-1] {
+			if l := x - prev; l < p.Min || l > p.Max {
+				t.Fatalf("%s: chunk %d is %d bytes", spec, i, l)
+			}
+			prev = x
+		}
+		if b := cuts(c2, data); len(moved(a, b, 0, 0)) != 0 {
+			t.Fatalf("%s: chunked the same data differently", spec)
+		}
+
+		// rewrite 100 bytes in the middle, then insert 37 there
+		at := len(data) / 2
+		edited := append([]byte(nil), data...)
+		copy(edited[at:], noise(6, 100))
+		inserted := append(append(append([]byte(nil), data[:at]...), noise(7, 37)...), data[at:]...)
+		for _, e := range []struct {
+			data  []byte
+			shift int
+		}{{edited, 0}, {inserted, 37}} {
+			if p.Kind == "fixed" && e.shift != 0 {
+				continue // everything after an insert moves
+			}
+			for _, x := range moved(a, cuts(c, e.data), at, e.shift) {
+				if x <= at || x > at+e.shift+4*p.Max {
+					t.Fatalf("%s: edit at %d (+%d) moved the cut at %d", spec, at, e.shift, x)
+				}
+			}
+		}
+	}
+}
+
+func TestParseChunkParams(t *testing.T) {
+	for spec, want := range map[string]ChunkParams{
+		"rk":                         DefaultChunkParams,
+		"rk:1024,2048,4096,16,7":     {"rk", 1024, 2048, 4096, 16, 7},
+		"fastcdc:16384,65536,262144": {"fastcdc", 16384, 65536, 262144, 0, 0},
+		"fastcdc:1024":               {"fastcdc", 1024, TARGETCHUNK, MAXCHUNK, 0, 0},
+		"fixed:1000":                 {"fixed", 1000, 1000, 1000, 0, 0},
+	} {
+		p, err := ParseChunkParams(spec)
+		if err != nil || p != want {
+			t.Fatalf("%q: %v %v, want %v", spec, p, err, want)
+		}
+		if q, err := ParseChunkParams(p.String()); err != nil || q != p {
+			t.Fatalf("%q: %s reads back as %v %v", spec, p, q, err)
+		}
+	}
+	for _, spec := range []string{"zip", "fixed:1,2", "fastcdc:1,2,3,4", "rk:0",
+		"rk:x", "rk:5000,4096,8192", "fastcdc:4,8,16", "rk:64,128,256,65"} {
+		if p, err := ParseChunkParams(spec); err == nil {
+			t.Fatalf("%q parsed as %v", spec, p)
+		}
+	}
+}
+
+// A store keeps the chunker it was created with, whatever it's reopened
+// with.
+func TestChunkerPersists(t *testing.T) {
+	t.Cleanup(func() {
+		ChunkSpec = ""
+		chunker = newRKChunker(DefaultChunkParams)
+	})
+	Merep = &Replica{Pid: 1}
+	Clients = map[int]*serverConn{}
+	path := filepath.Join(t.TempDir(), "db")
+	want, _ := ParseChunkParams("fastcdc:1024,4096,16384")
+	data := noise(8, 100<<10)
+
+	ChunkSpec = want.String()
+	Open(true, path)
+	createFile(t, "f", data)
+	for _, spec := range []string{"", "fixed:512"} {
+		db.Close()
+		ChunkSpec = spec
+		Open(false, path)
+		if head.Chunker != want || chunker.Params() != want {
+			t.Fatalf("reopened with %q: head %s, chunking with %s", spec, head.Chunker, chunker.Params())
+		}
+		if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, data) {
+			t.Fatalf("reopened with %q: read %d bytes back", spec, len(got))
+		}
+	}
+	db.Close()
+}
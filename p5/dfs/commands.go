@@ -0,0 +1,121 @@
+package dfs
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+)
+
+//=====================================================================
+// Commands run against a store: inside a mounted replica through its
+// control socket, or directly on the store of one that isn't running.
+//=====================================================================
+
+type command struct {
+	usage string
+	run   func(args []string) (string, error)
+}
+
+var commands map[string]*command
+
+// Commands that take what locks they need themselves, to wait on peers.
+var ownLocks = map[string]bool{"leave": true}
+
+func init() {
+	commands = map[string]*command{
+		"stats":     {"stats", cmdStats},
+		"gc":        {"gc [-current] [-n]", cmdGC},
+		"prune":     {"prune [-n] [policy]", cmdPrune},
+		"snapshot":  {"snapshot [list] | snapshot create|delete <name>", cmdSnapshot},
+		"holes":     {"holes <path>", cmdHoles},
+		"punch":     {"punch <path> <offset> <length>", cmdPunch},
+		"repl":      {"repl", cmdRepl},
+		"conflicts": {"conflicts [keep|take <path>]", cmdConflicts},
+		"members":   {"members", cmdMembers},
+		"leave":     {"leave", cmdLeave},
+	}
+}
+
+func commandUsage() string {
+	var lines []string
+	for _, c := range commands {
+		lines = append(lines, "\t"+c.usage)
+	}
+	sort.Strings(lines)
+	return "commands:\n" + strings.Join(lines, "\n") + "\n"
+}
+
+func runCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("%s", commandUsage())
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown command %q\n%s", args[0], commandUsage())
+	}
+	return c.run(args[1:])
+}
+
+// control socket lives next to the store
+func ctlPath(dbPath string) string {
+	if dbPath == "" || dbPath == MEMSTORE {
+		return ""
+	}
+	return strings.TrimRight(dbPath, "/") + ".ctl"
+}
+
+type Ctl struct{}
+
+func (c *Ctl) Run(args []string, reply *string) (err error) {
+	if len(args) > 0 && ownLocks[args[0]] {
+		*reply, err = runCommand(args)
+		return
+	}
+	in()
+	*reply, err = runCommand(args)
+	out()
+	sendOutbox()
+	return
+}
+
+func serveCtl(dbPath string) {
+	path := ctlPath(dbPath)
+	if path == "" {
+		return
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		p_err("control socket %q: %v\n", path, err)
+		return
+	}
+	os.Chmod(path, 0600)
+	srv := rpc.NewServer()
+	srv.Register(new(Ctl))
+	go srv.Accept(l)
+}
+
+// RunCommand runs args against the replica using dbPath: through its
+// control socket if it's mounted, otherwise on the store directly.
+func RunCommand(dbPath string, args []string) error {
+	var res string
+	var err error
+	if path := ctlPath(dbPath); path != "" {
+		if client, derr := rpc.Dial("unix", path); derr == nil {
+			err = client.Call("Ctl.Run", args, &res)
+			client.Close()
+			fmt.Print(res)
+			return err
+		}
+	}
+
+	Open(false, dbPath)
+	defer db.Close()
+
+	res, err = runCommand(args)
+	fmt.Print(res)
+	return err
+}
@@ -0,0 +1,211 @@
+package dfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// Compressed blocks are stored as BLKMAGIC, a codec byte, the plaintext
+// length (uvarint), then the compressed bytes. Blocks that don't shrink
+// are stored raw, so a store can mix codecs freely. Block keys are
+// always the hash of the plaintext, which is how we tell a raw block
+// that happens to start with BLKMAGIC from a compressed one.
+const BLKMAGIC = "\x00DFZ"
+
+var Compress = "none" // codec for new blocks
+
+type codec struct {
+	id     byte
+	writer func(io.Writer) io.WriteCloser
+	reader func(io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]*codec{
+	"flate": {1,
+		func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw },
+		func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil }},
+	"gzip": {2,
+		func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }},
+	"zlib": {3,
+		func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) }},
+}
+
+func codecNames() (names []string) {
+	names = append(names, "none")
+	for k := range codecs {
+		names = append(names, k)
+	}
+	sort.Strings(names[1:])
+	return
+}
+
+func ValidCodec(name string) bool {
+	_, ok := codecs[name]
+	return ok || name == "none"
+}
+
+func codecByID(id byte) (string, *codec) {
+	for name, c := range codecs {
+		if c.id == id {
+			return name, c
+		}
+	}
+	return "", nil
+}
+
+// Returns what to store for data: compressed with the current codec if
+// that's smaller, otherwise data itself.
+func encodeBlock(data []byte) []byte {
+	c, ok := codecs[Compress]
+	if !ok || len(data) == 0 {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.WriteString(BLKMAGIC)
+	buf.WriteByte(c.id)
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(data)))])
+	w := c.writer(&buf)
+	w.Write(data)
+	w.Close()
+	if buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// Parses a compressed block's header: codec name, plaintext length and
+// the compressed payload. ok is false for raw blocks.
+func blockHeader(stored []byte) (name string, c *codec, rawLen uint64, payload []byte, ok bool) {
+	if len(stored) <= len(BLKMAGIC) || string(stored[:len(BLKMAGIC)]) != BLKMAGIC {
+		return
+	}
+	if name, c = codecByID(stored[len(BLKMAGIC)]); c == nil {
+		return
+	}
+	rest := stored[len(BLKMAGIC)+1:]
+	rawLen, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return
+	}
+	return name, c, rawLen, rest[n:], true
+}
+
+// Inverse of encodeBlock. The decoded block is only believed if it
+// hashes to key; anything else is a raw block.
+func decodeBlock(key string, stored []byte) []byte {
+	_, c, rawLen, payload, ok := blockHeader(stored)
+	if !ok {
+		return stored
+	}
+	r, err := c.reader(bytes.NewReader(payload))
+	if err != nil {
+		return stored
+	}
+	defer r.Close()
+	plain, err := ioutil.ReadAll(r)
+	if err != nil || uint64(len(plain)) != rawLen || shaString(plain) != key {
+		return stored
+	}
+	return plain
+}
+
+//=============================================================================
+// Stats for blocks written by this process.
+
+type blockStats struct {
+	sync.Mutex
+	Blocks      uint64 // putBlock calls
+	RawBytes    uint64 // plaintext bytes
+	StoredBytes uint64 // bytes actually written
+	BadFetches  uint64 // blocks from other replicas that failed their hash
+}
+
+var stats blockStats
+
+func (s *blockStats) add(raw, stored int) {
+	s.Lock()
+	s.Blocks++
+	s.RawBytes += uint64(raw)
+	s.StoredBytes += uint64(stored)
+	s.Unlock()
+}
+
+func ratio(raw, stored uint64) float64 {
+	if stored == 0 {
+		return 1
+	}
+	return float64(raw) / float64(stored)
+}
+
+func (s *blockStats) badFetch() {
+	s.Lock()
+	s.BadFetches++
+	s.Unlock()
+}
+
+// "stats": compression over the whole store, and over this session
+func cmdStats(args []string) (string, error) {
+	type tally struct{ blocks, raw, stored uint64 }
+	byCodec := make(map[string]*tally)
+	var total tally
+	// only what is on disk here; blocks held only in S3 aren't downloaded
+	store := db
+	if c, ok := db.(*cachedStore); ok {
+		store = c.local
+	}
+	err := store.Iterate("", func(key string, val []byte) bool {
+		if !isSig(key) {
+			return true
+		}
+		// a raw block hashes to its own key, a compressed one doesn't
+		name, _, rawLen, _, ok := blockHeader(val)
+		if !ok || shaString(val) == key {
+			name, rawLen = "none", uint64(len(val))
+		}
+		t := byCodec[name]
+		if t == nil {
+			t = new(tally)
+			byCodec[name] = t
+		}
+		for _, t := range []*tally{t, &total} {
+			t.blocks++
+			t.raw += rawLen
+			t.stored += uint64(len(val))
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "codec for new blocks: %s\n", Compress)
+	fmt.Fprintf(&buf, "store: %d blocks, %d bytes raw, %d stored, ratio %.2f, saved %d\n",
+		total.blocks, total.raw, total.stored, ratio(total.raw, total.stored), int64(total.raw)-int64(total.stored))
+	for _, name := range codecNames() {
+		if t, ok := byCodec[name]; ok {
+			fmt.Fprintf(&buf, "  %-6s %d blocks, %d raw, %d stored, ratio %.2f\n",
+				name, t.blocks, t.raw, t.stored, ratio(t.raw, t.stored))
+		}
+	}
+	stats.Lock()
+	fmt.Fprintf(&buf, "session: %d puts, %d bytes raw, %d stored, ratio %.2f, saved %d\n",
+		stats.Blocks, stats.RawBytes, stats.StoredBytes,
+		ratio(stats.RawBytes, stats.StoredBytes), int64(stats.RawBytes)-int64(stats.StoredBytes))
+	if stats.BadFetches > 0 {
+		fmt.Fprintf(&buf, "session: %d blocks from other replicas failed their hash\n", stats.BadFetches)
+	}
+	stats.Unlock()
+	return buf.String(), nil
+}
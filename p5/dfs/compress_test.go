@@ -0,0 +1,78 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestCompressedBlocks(t *testing.T) {
+	testFS(t)
+	t.Cleanup(func() { Compress = "none" })
+	text := []byte(strings.Repeat("all work and no play makes jack a dull boy\n", 200))
+	for _, name := range codecNames()[1:] {
+		Compress = name
+		data := append([]byte(name), text...)
+		sig := putBlock(data)
+		stored, err := db.Get(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig != shaString(data) || shaString(stored) == sig {
+			t.Fatalf("%s: keyed %s, not by the plaintext's hash", name, sig)
+		}
+		if !bytes.HasPrefix(stored, []byte(BLKMAGIC)) || len(stored) >= len(data) {
+			t.Fatalf("%s: stored %d bytes of %d, not compressed", name, len(stored), len(data))
+		}
+		if got := getBlock(sig); !bytes.Equal(got, data) {
+			t.Fatalf("%s: read back %d bytes", name, len(got))
+		}
+
+		// what doesn't shrink is stored as it is
+		data = noise(9, 4096)
+		sig = putBlock(data)
+		if stored, _ := db.Get(sig); !bytes.Equal(stored, data) {
+			t.Fatalf("%s: incompressible block stored as %d bytes", name, len(stored))
+		}
+	}
+
+	// blocks from before compression, one of which looks like a
+	// compressed block, are read as they are
+	for _, old := range [][]byte{text, append([]byte(BLKMAGIC+"\x01\x05"), text...)} {
+		db.Put(shaString(old), old)
+		if got := getBlock(shaString(old)); !bytes.Equal(got, old) {
+			t.Fatalf("raw block read back as %d bytes", len(got))
+		}
+	}
+}
+
+// A file written before compression was turned on, then appended to
+// with it on, reads back whole.
+func TestCompressMixedFile(t *testing.T) {
+	testFS(t)
+	t.Cleanup(func() { Compress = "none" })
+	f := newSparseFile(t)
+	text := []byte(hex.EncodeToString(noise(10, 32<<10)))
+	f.write(0, text)
+	f.flush()
+	Compress = "zlib"
+	f.write(len(text), []byte(hex.EncodeToString(noise(11, 32<<10))))
+	f.flush()
+	flushRoot()
+	raw, packed := 0, 0
+	for _, sig := range f.n.DataBlocks {
+		if stored, _ := db.Get(sig); bytes.HasPrefix(stored, []byte(BLKMAGIC)) {
+			packed++
+		} else {
+			raw++
+		}
+	}
+	if raw == 0 || packed == 0 {
+		t.Fatalf("%d raw blocks, %d compressed", raw, packed)
+	}
+	restart()
+	if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, f.want) {
+		t.Fatalf("read %d bytes of %d; first difference at %d", len(got), len(f.want), firstDiff(got, f.want))
+	}
+}
@@ -0,0 +1,286 @@
+package dfs
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+//=============================================================================
+// Conflicts: concurrent versions of a node (see versions.go) meeting in
+// Receive. Ours is the node as it is here, loaded or not, so a laptop
+// that was edited offline and restarted keeps its edits; ones not
+// flushed yet are flushed first (see receiveNode).
+//
+// Of a file (or symlink), every replica keeps the same winner. The one
+// whose own version won also keeps the loser, as a sibling named
+// name.conflict-<replica>-<time> after the replica that wrote it and its
+// mtime, which reaches the others like any new file. The other replica
+// just takes the winner: its own version comes back as that sibling.
+//
+// Directories are merged, entry by entry, rather than won: a name on
+// either side is kept, and a name on both gets the newer version of the
+// child, or the winner if they're concurrent. So nothing is lost, but a
+// name removed on one side while the directory changed on the other comes
+// back. The rest of the directory (mode, times, ...) is the winner's.
+//
+// "conflicts" lists the siblings; "conflicts keep <path>" drops one,
+// "conflicts take <path>" makes it the file.
+
+const (
+	CONFLICT    = ".conflict-"
+	INOPIDSHIFT = 40
+)
+
+func replicaName(pid int) string {
+	if r := replica(pid); r != nil {
+		return r.Name
+	}
+	return fmt.Sprintf("replica%d", pid)
+}
+
+// Conflict copies are made by whichever replica finds the conflict,
+// without asking the others, so their inodes come from that replica's
+// own range, above any nextInd hands out: replica p's are p<<INOPIDSHIFT
+// on. Caller holds meta.
+func conflictIno() uint64 {
+	head.ConflictInd++
+	return uint64(Merep.Pid)<<INOPIDSHIFT | head.ConflictInd
+}
+
+// Keeps theirs, which lost to local, next to it. Called holding the tree
+// exclusively.
+func keepConflict(local, theirs *DNode) {
+	parent := local.parent
+	if parent == nil {
+		parent = nodeMap[local.Parent]
+	}
+	if parent == nil || local == root {
+		p_err("conflict on %q: nowhere to keep theirs\n", local.Name)
+		return
+	}
+	name := fmt.Sprintf("%s%s%s-%s", local.Name, CONFLICT, replicaName(theirs.Owner),
+		theirs.Attrs.Mtime.Format("20060102-150405"))
+	meta.Lock()
+	_, loaded := parent.kids[name]
+	_, stored := parent.ChildSigs[name]
+	if loaded || stored {
+		meta.Unlock()
+		return // kept already
+	}
+	p_err("conflict on %q: keeping theirs as %q\n", local.Name, name)
+	c := new(DNode)
+	*c = *theirs
+	c.Name = name
+	c.Attrs.Inode = conflictIno()
+	c.Attrs.Nlink = 1
+	c.Attrs.Ctime = time.Now()
+	c.Parent = parent.Attrs.Inode
+	c.parent = parent
+	c.PrevSig = ""
+	c.VV = nil
+	c.kids = make(map[string]*DNode)
+	c.sig = shaString(Marshal(c))
+	parent.kids[name] = c
+	nodeMap[c.Attrs.Inode] = c
+	markDirty(c)
+	meta.Unlock()
+}
+
+// Which of two entries for the same name, a from local and b from
+// theirs, the merge keeps. Their nodes were fetched before the tree was
+// taken (see receiveNode); if one still isn't here, the winner's is.
+func pickEntry(a, b string, theirsWin bool) string {
+	if a == b {
+		return a
+	}
+	winner := a
+	if theirsWin {
+		winner = b
+	}
+	if isInoRef(a) || isInoRef(b) {
+		return winner
+	}
+	da, db := getDNode(a), getDNode(b)
+	if da == nil || db == nil {
+		return winner
+	}
+	switch da.VV.compare(db.VV) {
+	case VV_NEWER:
+		return a
+	case VV_OLDER:
+		return b
+	case VV_CONCURRENT:
+		if db.VV.wins(da.VV) {
+			return b
+		}
+		return a
+	}
+	return winner
+}
+
+// Merges directory theirs, concurrent with local, into theirs. Entries
+// local has that it hasn't flushed yet are in its kids but not its
+// ChildSigs; those kids are returned, to be kept. Called holding the tree
+// exclusively.
+func mergeDir(local, theirs *DNode) (kids map[string]*DNode) {
+	theirsWin := theirs.VV.wins(local.VV)
+	if !theirsWin {
+		sigs, inodes, vv, ver := theirs.ChildSigs, theirs.Inodes, theirs.VV, theirs.Version
+		*theirs = *local
+		theirs.ChildSigs, theirs.Inodes, theirs.VV, theirs.Version = sigs, inodes, vv, ver
+	}
+	sigs := make(map[string]string)
+	for name, b := range theirs.ChildSigs {
+		sigs[name] = b
+	}
+	for name, a := range local.ChildSigs {
+		if b, ok := sigs[name]; ok {
+			sigs[name] = pickEntry(a, b, theirsWin)
+		} else {
+			sigs[name] = a
+		}
+	}
+	theirs.ChildSigs = sigs
+	if local.Inodes != nil || theirs.Inodes != nil {
+		inodes := make(map[uint64]string)
+		for ino, b := range theirs.Inodes {
+			inodes[ino] = b
+		}
+		for ino, a := range local.Inodes {
+			if b, ok := inodes[ino]; ok {
+				inodes[ino] = pickEntry(a, b, theirsWin)
+			} else {
+				inodes[ino] = a
+			}
+		}
+		theirs.Inodes = inodes
+	}
+	theirs.VV = theirs.VV.merge(local.VV)
+
+	kids = make(map[string]*DNode)
+	for name, k := range local.kids {
+		if sigs[name] == local.ChildSigs[name] {
+			kids[name] = k
+		}
+	}
+	return kids
+}
+
+// Whether the merge changed nothing of a's entries.
+func sameEntries(a, b *DNode) bool {
+	return reflect.DeepEqual(a.ChildSigs, b.ChildSigs) &&
+		len(a.Inodes) == len(b.Inodes) && (len(a.Inodes) == 0 || reflect.DeepEqual(a.Inodes, b.Inodes))
+}
+
+// Every conflict sibling under n, as paths from the root.
+func findConflicts(n *DNode, path string, l []string) []string {
+	meta.Lock()
+	var names []string
+	for name := range n.ChildSigs {
+		names = append(names, name)
+	}
+	for name := range n.kids {
+		if _, ok := n.ChildSigs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	meta.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		c := n.loadChild(name)
+		if c == nil {
+			continue
+		}
+		if strings.Contains(name, CONFLICT) {
+			l = append(l, path+name)
+		}
+		if c.Attrs.Mode.IsDir() {
+			l = findConflicts(c, path+name+"/", l)
+		}
+	}
+	return l
+}
+
+// "conflicts [keep|take <path>]"
+func cmdConflicts(args []string) (string, error) {
+	if len(args) == 0 {
+		var buf bytes.Buffer
+		for _, p := range findConflicts(root, "", nil) {
+			fmt.Fprintf(&buf, "%s\n", p)
+		}
+		return buf.String(), nil
+	}
+	if len(args) != 2 || (args[0] != "keep" && args[0] != "take") {
+		return "", fmt.Errorf("usage: %s", commands["conflicts"].usage)
+	}
+	path := strings.Trim(args[1], "/")
+	i := strings.LastIndex(path, CONFLICT)
+	if i < 0 || strings.Contains(path[i:], "/") {
+		return "", fmt.Errorf("%s: not a conflict", args[1])
+	}
+	dirPath, name := "", path
+	if j := strings.LastIndex(path, "/"); j >= 0 {
+		dirPath, name = path[:j], path[j+1:]
+	}
+	orig := name[:strings.LastIndex(name, CONFLICT)]
+	dir, err := lookupPath(dirPath)
+	if err != nil {
+		return "", err
+	}
+	dir.lock()
+	c := dir.loadChild(name)
+	if c == nil {
+		dir.unlock()
+		return "", fmt.Errorf("%s: no such file", args[1])
+	}
+	o := dir.loadChild(orig)
+	if o != nil && o.Attrs.Mode.IsDir() {
+		dir.unlock()
+		return "", fmt.Errorf("%s: %s is a directory", args[1], orig)
+	}
+
+	switch {
+	case args[0] == "keep":
+		dir.unlink(name)
+	case o == nil:
+		// the original's gone: the copy takes its name
+		meta.Lock()
+		delete(dir.kids, name)
+		delete(dir.ChildSigs, name)
+		c.Name = orig
+		dir.kids[orig] = c
+		markDirty(c)
+		meta.Unlock()
+	default:
+		o.lock()
+		if o.opens > 0 || o.dirty {
+			// its writes would be lost, or land on the copy's data
+			o.unlock()
+			dir.unlock()
+			return "", fmt.Errorf("%s: %s is open", args[1], orig)
+		}
+		meta.Lock()
+		o.setExtents(c.DataBlocks, c.BlockLens)
+		o.Owner = c.Owner
+		o.Target = c.Target
+		o.Xattrs = c.Xattrs
+		o.Attrs.Size = c.Attrs.Size
+		o.Attrs.Mode = c.Attrs.Mode
+		o.Attrs.Mtime = c.Attrs.Mtime
+		o.Attrs.Ctime = time.Now()
+		markDirty(o)
+		meta.Unlock()
+		o.unlock()
+		dir.unlink(name)
+	}
+	dir.unlock()
+	flushRoot()
+	if args[0] == "keep" {
+		return fmt.Sprintf("removed %s\n", args[1]), nil
+	}
+	return fmt.Sprintf("%s replaced by %s\n", orig, args[1]), nil
+}
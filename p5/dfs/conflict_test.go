@@ -0,0 +1,174 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// One replica's share of the package state, so two can run in a test.
+type testReplica struct {
+	db      BlockStore
+	me      *Replica
+	root    *DNode
+	head    *Head
+	nodes   map[uint64]*DNode
+	places  map[uint64]place
+	nextInd uint64
+	version uint64
+}
+
+func (r *testReplica) save() {
+	r.db, r.me, r.root, r.head, r.nodes, r.places = db, Merep, root, head, nodeMap, placeOf
+	r.nextInd, r.version = nextInd, version
+}
+
+func (r *testReplica) use() {
+	db, Merep, root, head, nodeMap, placeOf = r.db, r.me, r.root, r.head, r.nodes, r.places
+	nextInd, version = r.nextInd, r.version
+}
+
+// Hands what from has queued to to, blocks first, as Receive would
+// after fetching them. Leaves to in use; returns how many were sent.
+func deliver(from, to *testReplica) int {
+	from.use()
+	outbox.Lock()
+	msgs := outbox.msgs
+	outbox.msgs = nil
+	outbox.Unlock()
+	blocks := make(map[string][]byte)
+	db.Iterate("", func(key string, val []byte) bool {
+		if b := getBlock(key); b != nil && shaString(b) == key {
+			blocks[key] = val
+		}
+		return true
+	})
+	from.save()
+
+	to.use()
+	for key, val := range blocks {
+		db.Put(key, val)
+	}
+	for _, m := range msgs {
+		var n DNode
+		json.Unmarshal(m.buf, &n)
+		receiveNode(n)
+	}
+	to.save()
+	return len(msgs)
+}
+
+// A laptop edits a file offline and restarts; another replica edits it
+// too. Once they've exchanged updates, both have both versions, and agree
+// on which is which.
+func TestOfflineConflict(t *testing.T) {
+	base, ours, theirs := noise(0, 2000), noise(1, 3000), noise(2, 4000)
+	Replicas = map[int]*Replica{1: {Name: "laptop", Pid: 1}, 2: {Name: "server", Pid: 2}}
+	defer func() { Replicas = nil }()
+
+	var laptop, server testReplica
+	f := newSparseFile(t)
+	Merep = Replicas[1]
+	f.write(0, base)
+	f.flush()
+	flushRoot()
+	outbox.Lock()
+	outbox.msgs = nil
+	outbox.Unlock()
+	clone := NewMemStore()
+	db.Iterate("", func(key string, val []byte) bool {
+		clone.Put(key, val)
+		return true
+	})
+
+	// offline on the laptop, then a restart
+	f.write(0, ours)
+	f.flush()
+	flushRoot()
+	restart()
+	laptop.save()
+
+	db = clone
+	Merep = Replicas[2]
+	restart()
+	g := lookup(t, root, "f")
+	g.lock()
+	meta.Lock()
+	g.setExtents(putBlocks(theirs))
+	g.Attrs.Size = uint64(len(theirs))
+	markDirty(g)
+	meta.Unlock()
+	g.unlock()
+	createFile(t, "h", noise(3, 100)) // taking the inode the laptop would next
+	server.save()
+
+	for i := 0; deliver(&server, &laptop)+deliver(&laptop, &server) > 0; i++ {
+		if i > 5 {
+			t.Fatal("still exchanging updates")
+		}
+	}
+
+	var got [2][2][]byte
+	for i, r := range []*testReplica{&laptop, &server} {
+		r.use()
+		copies := conflictCopies("f")
+		if len(copies) != 1 {
+			t.Fatalf("%s: %d conflict copies, want 1", r.me.Name, len(copies))
+		}
+		c := lookup(t, root, copies[0])
+		if pid := c.Attrs.Inode >> INOPIDSHIFT; pid != 1 && pid != 2 {
+			t.Fatalf("%s: conflict copy has inode %d, not from a replica's range", r.me.Name, c.Attrs.Inode)
+		}
+		inodes := make(map[uint64]string)
+		for _, name := range []string{"f", "h", copies[0]} {
+			ino := lookup(t, root, name).Attrs.Inode
+			if other, ok := inodes[ino]; ok {
+				t.Fatalf("%s: %s and %s are both inode %d", r.me.Name, other, name, ino)
+			}
+			inodes[ino] = name
+		}
+		got[i] = [2][]byte{contents(t, lookup(t, root, "f")), contents(t, c)}
+		if !(bytes.Equal(got[i][0], ours) && bytes.Equal(got[i][1], theirs) ||
+			bytes.Equal(got[i][0], theirs) && bytes.Equal(got[i][1], ours)) {
+			t.Fatalf("%s: lost a version (f %d bytes, copy %d)", r.me.Name, len(got[i][0]), len(got[i][1]))
+		}
+		r.save()
+	}
+	if !bytes.Equal(got[0][0], got[1][0]) {
+		t.Fatal("the replicas kept different versions as f")
+	}
+}
+
+// Taking a conflict copy refuses while the file is open, rather than
+// drop what's been written to it.
+func TestConflictTakeOpen(t *testing.T) {
+	ours, theirs := noise(1, 3000), noise(2, 4000)
+	f := newSparseFile(t)
+	f.write(0, noise(0, 2000))
+	f.flush()
+	flushRoot()
+	f.write(0, ours)
+	receiveNode(remoteEdit(root.ChildSigs["f"], theirs))
+	keptBoth(t, ours, theirs)
+	copies := conflictCopies("f")
+
+	f.write(len(ours), noise(3, 500)) // not flushed yet
+	if _, err := cmdConflicts([]string{"take", copies[0]}); err == nil {
+		t.Fatal("took a copy over an open file")
+	}
+	f.check("refused")
+	f.flush()
+	f.h.Release(context.Background(), &fuse.ReleaseRequest{})
+	if _, err := cmdConflicts([]string{"take", copies[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, theirs) {
+		t.Fatalf("f has %d bytes, not theirs", len(got))
+	}
+	if len(conflictCopies("f")) != 0 {
+		t.Fatal("copy still there")
+	}
+}
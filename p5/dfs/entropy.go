@@ -0,0 +1,127 @@
+package dfs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//=============================================================================
+// Anti-entropy. Pushes (replicate.go) only reach replicas that are up, so
+// every SyncPeriod seconds, and once at startup, each replica compares its
+// root with every other's and pulls what it's missed.
+//
+// The tree is a Merkle tree: a child whose sig is the same on both sides
+// is the same subtree, and is skipped, as is one whose version vector ours
+// already covers (a change anywhere under a node is a flush of the node
+// too). What's left is fetched, children first, and applied through
+// receiveNode as if it had been pushed, chunks and all.
+//
+// The other way round, a peer whose root covers ours has everything we'd
+// numbered when we looked, which is how one that had updates dropped
+// from its queue gets back into the write quorum.
+
+var SyncPeriod = 30 // seconds between passes, 0 for none
+
+func AntiEntropy() {
+	for {
+		for _, pid := range peerPids() {
+			syncPeer(pid)
+		}
+		time.Sleep(time.Duration(SyncPeriod) * time.Second)
+	}
+}
+
+// Pulls whatever pid has that we haven't.
+func syncPeer(pid int) {
+	var h Head
+	if c := clients()[pid]; c == nil || c.connect() != nil {
+		syncDone(pid, 0, false)
+		return
+	}
+	b := reqBlock(pid, "Node.ReqData", "head")
+	if b == nil || json.Unmarshal(b, &h) != nil || h.Root == "" {
+		syncDone(pid, 0, false)
+		return
+	}
+	repl.Lock()
+	seq := repl.seq // head.Root has everything numbered so far
+	repl.Unlock()
+	meta.Lock()
+	ours := head.Root
+	meta.Unlock()
+	pulled := 0
+	if h.Root != ours {
+		p_out("sync with %d: root %s, ours %s\n", pid, h.Root, ours)
+		pulled = syncNode(pid, h.Root)
+	}
+	syncDone(pid, pulled, true)
+	if covers(pid, h.Root, ours) {
+		caughtUp(pid, seq)
+	}
+}
+
+// Whether pid's root theirs has everything our root ours has.
+func covers(pid int, theirs, ours string) bool {
+	if theirs == ours {
+		return true
+	}
+	t, o := fetchDNode(pid, theirs), getDNode(ours)
+	if t == nil || o == nil {
+		return false
+	}
+	c := t.VV.compare(o.VV)
+	return c == VV_EQUAL || c == VV_NEWER
+}
+
+// Brings over pid's version sig of a node, and what's changed under it.
+// Returns how many nodes it pulled.
+func syncNode(pid int, sig string) int {
+	theirs := fetchDNode(pid, sig)
+	if theirs == nil {
+		p_err("sync with %d: can't fetch %s\n", pid, sig)
+		return 0
+	}
+	vv, sigs, inodes, ok := localView(theirs.Attrs.Inode)
+	if ok {
+		if c := theirs.VV.compare(vv); c == VV_EQUAL || c == VV_OLDER {
+			return 0
+		}
+	}
+	pulled := 0
+	for name, csig := range theirs.ChildSigs {
+		if !isInoRef(csig) && csig != sigs[name] {
+			pulled += syncNode(pid, csig)
+		}
+	}
+	for ino, fsig := range theirs.Inodes {
+		if fsig != inodes[ino] {
+			pulled += syncNode(pid, fsig)
+		}
+	}
+	if receiveNode(*theirs) {
+		pulled++
+	}
+	return pulled
+}
+
+// Our version of a node, the same one receiveNode compares with: the one
+// in memory, or else the one stored, which is loaded.
+func localView(ino uint64) (vv VClock, sigs map[string]string, inodes map[uint64]string, ok bool) {
+	in()
+	n := storedNode(ino)
+	meta.Lock()
+	if n != nil {
+		vv, ok = n.VV, true
+		sigs = make(map[string]string, len(n.ChildSigs))
+		for name, s := range n.ChildSigs {
+			sigs[name] = s
+		}
+		inodes = make(map[uint64]string, len(n.Inodes))
+		for i, s := range n.Inodes {
+			inodes[i] = s
+		}
+	}
+	meta.Unlock()
+	out()
+	return
+}
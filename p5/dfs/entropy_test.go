@@ -0,0 +1,30 @@
+package dfs
+
+import "testing"
+
+// A restarted replica pulling a version concurrent with its offline
+// edits keeps both, as it would if the version had been pushed.
+func TestSyncKeepsOfflineEdits(t *testing.T) {
+	ours, theirs := noise(1, 3000), noise(2, 4000)
+	f := newSparseFile(t)
+	f.write(0, noise(0, 2000))
+	f.flush()
+	flushRoot()
+	base, sig := head.Root, root.ChildSigs["f"]
+
+	f.write(0, ours)
+	f.flush()
+	flushRoot()
+	restart()
+
+	// replica 2's tree: f changed from the same base
+	tf := remoteEdit(sig, theirs)
+	tr := *getDNode(base)
+	tr.ChildSigs = map[string]string{"f": putBlock(Marshal(&tf))}
+	tr.VV = tr.VV.bump(2)
+	tr.Owner = 2
+	if pulled := syncNode(2, putBlock(Marshal(&tr))); pulled == 0 {
+		t.Fatal("nothing pulled")
+	}
+	keptBoth(t, ours, theirs)
+}
@@ -1,53 +1,128 @@
 package dfs
 
 import (
+	"sync"
 	"time"
 )
 
-func flush(n *DNode) string {
+// One flush at a time, so versions go out in order.
+var flushMu sync.Mutex
+
+// What the last flushes have for the other replicas, in order; see
+// replicate.go.
+var outbox struct {
+	sync.Mutex
+	msgs []outMsg
+}
+
+// Dirty nodes at and below n, children first. Linked files that changed
+// are collected at the root, whichever directory they were reached
+// through. Caller holds meta.
+func dirtyNodes(n *DNode, seen map[*DNode]bool, l []*DNode) []*DNode {
 	for _, val := range n.kids {
-		if val.metaDirty {
+		if val.metaDirty && !seen[val] {
 			n.metaDirty = true // sanity check
-			n.ChildSigs[val.Name] = flush(val)
+			l = dirtyNodes(val, seen, l)
+		}
+	}
+	if n == root {
+		for ino := range root.Inodes {
+			if f := nodeMap[ino]; f != nil && f.metaDirty && !seen[f] {
+				root.metaDirty = true
+				l = dirtyNodes(f, seen, l)
+			}
 		}
 	}
 	if n.metaDirty {
-		n.Version = version
-		tmp := putBlock(Marshal(n))
-		for _, c := range Clients {
-			var enc_reply []byte
-			req := aesEncrypt(AESkey, Marshal(n))
-			c.Call("Node.Receive", &req, &enc_reply)
+		seen[n] = true
+		l = append(l, n)
+	}
+	return l
+}
+
+// Writes n, pointing it at the kids flushed so far in this pass. n stays
+// dirty if a kid was changed again meanwhile.
+func flushNode(n *DNode, flushed map[*DNode]string) {
+	n.rlock()
+	meta.Lock()
+	redirty := false
+	for name, val := range n.kids {
+		if isInoRef(n.ChildSigs[name]) {
+			continue // in the root's table, below
+		}
+		if sig, ok := flushed[val]; ok {
+			n.ChildSigs[name] = sig
 		}
-		n.PrevSig = tmp
-		n.sig = n.PrevSig
-		n.metaDirty = false
+		redirty = redirty || val.metaDirty
 	}
-	return n.sig
+	if n == root {
+		for ino := range root.Inodes {
+			f := nodeMap[ino]
+			if sig, ok := flushed[f]; ok {
+				root.Inodes[ino] = sig
+			}
+			redirty = redirty || (f != nil && f.metaDirty)
+		}
+	}
+	n.Version = version
+	n.VV = n.VV.bump(Merep.Pid)
+	buf := Marshal(n)
+	n.PrevSig = shaString(buf)
+	n.sig = n.PrevSig
+	n.metaDirty = redirty
+	flushed[n] = n.sig
+	meta.Unlock()
+	n.runlock()
+
+	putBlock(buf)
+	outbox.Lock()
+	outbox.msgs = append(outbox.msgs, outMsg{buf: buf})
+	outbox.Unlock()
 }
 
+// Flushes everything dirty and moves the head, or if nothing is, queues
+// the root for the other replicas as a heartbeat. Called with the tree
+// lock held, shared or not.
 func flushRoot() {
-	if root.metaDirty {
-		flush(root)
-		version++
-
-		head.Root = root.PrevSig
-		head.NextInd = nextInd
-		putBlockSig("head", Marshal(head))
-	} else {
-		for _, c := range Clients {
-			var enc_reply []byte
-			req := aesEncrypt(AESkey, Marshal(root))
-			c.Call("Node.Receive", &req, &enc_reply)
-		}
+	flushMu.Lock()
+	meta.Lock()
+	dirty := root.metaDirty
+	var l []*DNode
+	if dirty {
+		l = dirtyNodes(root, make(map[*DNode]bool), nil)
 	}
+	buf := Marshal(root)
+	meta.Unlock()
+
+	if !dirty {
+		outbox.Lock()
+		outbox.msgs = append(outbox.msgs, outMsg{buf: buf, heartbeat: true})
+		outbox.Unlock()
+		flushMu.Unlock()
+		return
+	}
+	flushed := make(map[*DNode]string)
+	for _, n := range l {
+		flushNode(n, flushed)
+	}
+
+	meta.Lock()
+	version++
+	head.Root = root.PrevSig
+	head.NextInd = nextInd
+	buf = Marshal(head)
+	meta.Unlock()
+	putBlockSig("head", buf)
+	flushMu.Unlock()
 }
 
-func Flusher(sem chan int) {
+func Flusher() {
 	for {
 		time.Sleep(time.Duration(FlusherPeriod) * time.Second)
-		in()
+		tree.RLock()
 		flushRoot()
-		out()
+		tree.RUnlock()
+		autoPrune()
+		sendOutbox()
 	}
 }
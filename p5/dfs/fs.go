@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"bazil.org/fuse"
@@ -20,15 +21,25 @@ type DNode struct {
 	PrevSig    string
 	ChildSigs  map[string]string
 	DataBlocks []string
+	BlockLens  []uint64 // length of each of DataBlocks
 	Owner      int
 	Parent     uint64
+	Inodes     map[uint64]string `json:",omitempty"` // root only: hard-linked files, see links.go
+	Target     string            `json:",omitempty"` // symlinks only
+	Xattrs     map[string][]byte `json:",omitempty"`
+	VV         VClock            `json:",omitempty"` // flushes by each replica, see versions.go
 
 	sig       string
-	dirty     bool
+	dirty     bool      // data changed since the last Flush
+	wins      []*window // what's being written, by offset; see sparse.go
+	extOff    []uint64  // start of each extent, worked out from BlockLens
 	metaDirty bool
+	archive   bool   // historical version, read-only
+	snaps     *DNode // for a .snapshots dir, whose versions it lists
+	snapGen   uint64 // snapGen as of the last listing
 	parent    *DNode
 	kids      map[string]*DNode
-	data      []byte
+	opens     int // open Handles, guarded by the inode lock
 }
 
 func (d *DNode) String() string {
@@ -59,15 +70,18 @@ func (d *DNode) init(name string, mode os.FileMode) {
 }
 
 type Head struct {
-	Root    string
-	NextInd uint64
-	Replica uint64
+	Root        string
+	NextInd     uint64
+	Replica     uint64
+	ConflictInd uint64 // the last conflict copy's, see conflictIno
+	Chunker     ChunkParams
 }
 
 var Debug = false
 var FlusherPeriod = 5
 var ModeConsistency = "none"
 var Token = false
+var ChunkSpec = "" // chunker for new stores, see ParseChunkParams
 
 var uid = uint32(os.Geteuid())
 var gid = uint32(os.Getegid())
@@ -75,7 +89,6 @@ var root *DNode
 var head *Head
 var nextInd uint64 = 1
 var version uint64 = 1
-var sem chan int
 
 var nodeMap map[uint64]*DNode
 
@@ -85,7 +98,7 @@ type FS struct{}
 // Let one at a time in
 
 func getHead() (*DNode, uint64) {
-	if val, err := db.Get([]byte("head"), nil); err == nil {
+	if val, err := db.Get("head"); err == nil {
 		p_out("FOUND HEAD!")
 		json.Unmarshal(val, &head)
 		return getDNode(head.Root), head.NextInd
@@ -93,10 +106,27 @@ func getHead() (*DNode, uint64) {
 	return nil, 0
 }
 
-func Init(mountPoint string, newfs bool, dbPath string) {
-	nodeMap = make(map[uint64]*DNode)
-	initStore(newfs, dbPath)
+// Use the chunker the store was created with; stores from before
+// chunkers were configurable used the defaults.
+func initChunker() {
+	if head.Chunker.Kind == "" {
+		head.Chunker = DefaultChunkParams
+	}
+	if ChunkSpec != "" {
+		if p, err := ParseChunkParams(ChunkSpec); err != nil || p != head.Chunker {
+			p_err("store uses chunker %s, ignoring %q\n", head.Chunker, ChunkSpec)
+		}
+	}
+	var err error
+	chunker, err = NewChunker(head.Chunker)
+	p_dieif(err != nil, "chunker: %v\n", err)
+}
 
+// Load the root from the head (or the snapshot being mounted), or start
+// a new file system.
+func loadRoot() {
+	placeOf = nil
+	loadSnapshots()
 	if n, ni := getHead(); n != nil {
 		root = n
 		root.sig = head.Root
@@ -112,8 +142,34 @@ func Init(mountPoint string, newfs bool, dbPath string) {
 		head = new(Head)
 		head.Root = root.sig
 		head.NextInd = nextInd
+		head.Chunker = DefaultChunkParams
+		if ChunkSpec != "" {
+			var err error
+			head.Chunker, err = ParseChunkParams(ChunkSpec)
+			p_dieif(err != nil, "chunker: %v\n", err)
+		}
 		nodeMap[root.Attrs.Inode] = root
 	}
+	initChunker()
+
+	if MountSnapshot != "" {
+		delete(nodeMap, root.Attrs.Inode)
+		root = snapshotRoot(MountSnapshot)
+		nodeMap[root.Attrs.Inode] = root
+	}
+}
+
+// Opens the file system stored at dbPath (a LevelDB directory, or
+// MEMSTORE), without mounting it; Init does this first.
+func Open(newfs bool, dbPath string) {
+	nodeMap = make(map[uint64]*DNode)
+	initStore(newfs, dbPath)
+	loadRoot()
+	initRetention()
+}
+
+func Init(mountPoint string, newfs bool, dbPath string) {
+	Open(newfs, dbPath)
 	p_out("root %q", root)
 	p_out("root inode %v", root.Attrs.Inode)
 
@@ -121,8 +177,14 @@ func Init(mountPoint string, newfs bool, dbPath string) {
 		p_err("mount pt creation fail\n")
 	}
 
+	// other users only get in with allow_other (and user_allow_other in
+	// /etc/fuse.conf); perm.go does the checking, not the kernel
+	var opts []fuse.MountOption
+	if Merep != nil && Merep.Opts["allow_other"] != "" {
+		opts = append(opts, fuse.AllowOther())
+	}
 	fuse.Unmount(mountPoint)
-	c, err := fuse.Mount(mountPoint)
+	c, err := fuse.Mount(mountPoint, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -133,12 +195,27 @@ func Init(mountPoint string, newfs bool, dbPath string) {
 		<-ch
 		defer c.Close()
 		defer db.Close()
+		if path := ctlPath(dbPath); path != "" {
+			os.Remove(path)
+		}
 		fuse.Unmount(mountPoint)
 		os.Exit(1)
 	}()
 
-	sem = make(chan int, 1)
-	go Flusher(sem)
+	if MountSnapshot == "" { // nothing to flush, and nothing to tell peers
+		loadMembers()
+		for _, c := range clients() {
+			go c.connect() // so reads find them connected (see callUp)
+		}
+		if n := len(clients()) + 1; WriteQuorum > n {
+			p_err("write quorum %d, but only %d replicas: fsync will always fail\n", WriteQuorum, n)
+		}
+		go Flusher()
+		if SyncPeriod > 0 {
+			go AntiEntropy()
+		}
+	}
+	serveCtl(dbPath)
 
 	err = fs.Serve(c, FS{})
 	if err != nil {
@@ -152,12 +229,87 @@ func Init(mountPoint string, newfs bool, dbPath string) {
 	}
 }
 
+//=============================================================================
+// Locking, outermost first:
+//
+//	tree   every request holds it shared; whole-tree work (Receive,
+//	       commands, pruning) holds it exclusively with in()/out()
+//	inode  one RWMutex per inode (see lock()): a file's contents (wins,
+//	       DataBlocks, BlockLens, Owner, Size) or a directory's entries.
+//	       May be held across block I/O. Rename takes two, in inode order.
+//	meta   names, attributes, xattrs and dirty flags of every DNode, and
+//	       nodeMap, nextInd, version, head and root.Inodes. Never held
+//	       across block I/O or RPCs.
+//
+// Flushes run one at a time, locking one node at a time, and what they
+// send other replicas goes out once every lock is dropped (sendOutbox).
+
+var tree sync.RWMutex
+var meta sync.Mutex
+
+var inodeLocks = struct {
+	sync.Mutex
+	m map[uint64]*sync.RWMutex
+}{m: make(map[uint64]*sync.RWMutex)}
+
+// Whole tree, exclusively.
 func in() {
-	sem <- 1
+	tree.Lock()
 }
 
 func out() {
-	<-sem
+	tree.Unlock()
+}
+
+// Any request on n.
+func enter(n *DNode) {
+	getToken()
+	tree.RLock()
+	findDNode(n)
+}
+
+func leave() {
+	tree.RUnlock()
+}
+
+// n's inode lock. Hard links share it; history views (inode 0) all share
+// one, but only ever read.
+func (n *DNode) inodeLock() *sync.RWMutex {
+	inodeLocks.Lock()
+	l, ok := inodeLocks.m[n.Attrs.Inode]
+	if !ok {
+		l = new(sync.RWMutex)
+		inodeLocks.m[n.Attrs.Inode] = l
+	}
+	inodeLocks.Unlock()
+	return l
+}
+
+func (n *DNode) lock()    { n.inodeLock().Lock() }
+func (n *DNode) unlock()  { n.inodeLock().Unlock() }
+func (n *DNode) rlock()   { n.inodeLock().RLock() }
+func (n *DNode) runlock() { n.inodeLock().RUnlock() }
+
+// Locks two directories for a rename, lower inode first.
+func lockDirs(a, b *DNode) {
+	la, lb := a.inodeLock(), b.inodeLock()
+	if la == lb {
+		la.Lock()
+		return
+	}
+	if b.Attrs.Inode < a.Attrs.Inode {
+		la, lb = lb, la
+	}
+	la.Lock()
+	lb.Lock()
+}
+
+func unlockDirs(a, b *DNode) {
+	la, lb := a.inodeLock(), b.inodeLock()
+	la.Unlock()
+	if lb != la {
+		lb.Unlock()
+	}
 }
 
 //=============================================================================
@@ -2,6 +2,10 @@ package dfs
 
 import (
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -12,61 +16,201 @@ import (
 
 //=============================================================================
 
-func (n *DNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	in()
-	findDNode(n)
+func (n *DNode) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	who := callerOf(req.Header)
+	enter(n)
+	name := req.Name
 	// p_out("Lookup for %q in \n%q\n", name, n)
+	meta.Lock()
+	ok := access(n, who, P_EXEC)
+	meta.Unlock()
+	if !ok {
+		leave()
+		return nil, EACCES
+	}
+	n.rlock()
+	n.refreshSnapshots()
+	if child := n.loadChild(name); child != nil {
+		n.runlock()
+		leave()
+		return child, nil
+	}
+	if !n.archive { // history views, never stored in kids
+		var v *DNode
+		if name == SNAPDIR {
+			v = n.snapshotsDir()
+		} else {
+			v = n.historyView(name)
+		}
+		if v != nil {
+			n.runlock()
+			leave()
+			return v, nil
+		}
+	}
+	meta.Lock()
+	_, listed := n.ChildSigs[name]
+	meta.Unlock()
+	n.runlock()
+	leave()
+	if listed {
+		// nobody has a copy that checks out
+		p_err("Lookup: %q in %q can't be fetched\n", name, n.Name)
+		return nil, fuse.EIO
+	}
+	return nil, fuse.ENOENT // doesn't exist
+}
+
+// Child name, from memory or from the store. nil if there isn't one.
+// Called with n's inode lock held, and not meta: that's dropped while
+// the child is fetched, so another lookup may get there first.
+func (n *DNode) loadChild(name string) *DNode {
+	meta.Lock()
 	if child, ok := n.kids[name]; ok { // in memory
 		// p_out("IN MEMORY\n\n")
-		out()
-		return child, nil
+		meta.Unlock()
+		return child
 	}
-	if child, ok := n.ChildSigs[name]; ok { // not in memory
-		// p_out("ON DISK\n\n")
-		node := getDNode(child)
-		if node == nil {
-			if node = getRemoteDNode(n.Owner, child); node == nil {
-				out()
-				return nil, fuse.ENOENT // doesn't exist
-			}
+	ref, ok := n.ChildSigs[name]
+	if !ok {
+		meta.Unlock()
+		return nil
+	}
+	if isInoRef(ref) && !n.archive { // linked, maybe already in via another name
+		if node := nodeMap[refIno(ref)]; node != nil {
+			n.kids[name] = node
+			meta.Unlock()
+			return node
 		}
-		node.parent = n
+	}
+	// p_out("ON DISK\n\n")
+	child, _ := n.childSig(name)
+	owner := n.Owner
+	meta.Unlock()
+	node := fetchDNode(owner, child)
+	if node == nil {
+		return nil // doesn't exist
+	}
+	meta.Lock()
+	if c, ok := n.kids[name]; ok {
+		meta.Unlock()
+		return c
+	}
+	if c := nodeMap[node.Attrs.Inode]; c != nil && isInoRef(ref) && !n.archive {
+		n.kids[name] = c
+		meta.Unlock()
+		return c
+	}
+	node.parent = n
+	node.sig = child
+	n.kids[name] = node
+	if n.archive {
+		node.archive = true
+		node.Attrs.Inode = 0
+	} else {
 		node.Parent = n.Attrs.Inode
-		node.sig = child
-		n.kids[name] = node
 		nodeMap[node.Attrs.Inode] = node
-		out()
-		return node, nil
 	}
-	out()
-	return nil, fuse.ENOENT // doesn't exist
+	meta.Unlock()
+	return node
+}
+
+func (n *DNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	who := callerOf(req.Header)
+	enter(n)
+	var want uint32
+	switch {
+	case req.Dir || req.Flags.IsReadOnly():
+		want = P_READ
+	case req.Flags.IsWriteOnly():
+		want = P_WRITE
+	case req.Flags.IsReadWrite():
+		want = P_READ | P_WRITE
+	}
+	if req.Flags&fuse.OpenTruncate != 0 {
+		want |= P_WRITE
+	}
+	meta.Lock()
+	if want&P_WRITE != 0 && inArchive(n) {
+		meta.Unlock()
+		leave()
+		return nil, fuse.EPERM
+	}
+	if !access(n, who, want) {
+		meta.Unlock()
+		leave()
+		return nil, EACCES
+	}
+	isDir := n.Attrs.Mode.IsDir()
+	meta.Unlock()
+	if req.Dir || isDir {
+		leave()
+		return n, nil
+	}
+	h := n.open(req.Flags)
+	leave()
+	return h, nil
 }
 
 func (n *DNode) Attr(ctx context.Context, attr *fuse.Attr) error {
-	in()
-	findDNode(n)
+	enter(n)
 	// p_out("Attr %q <- \n%q\n\n", attr, n)
+	meta.Lock()
 	*attr = n.Attrs
-	out()
+	meta.Unlock()
+	leave()
 	return nil
 }
 
 func (n *DNode) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
-	in()
-	findDNode(n)
+	enter(n)
 	// p_out("Getattr for %q in \n%q\n\n", req, n)
+	meta.Lock()
 	resp.Attr = n.Attrs
-	out()
+	meta.Unlock()
+	leave()
 	return nil
 }
 
 func (n *DNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	in()
-	findDNode(n)
+	who := callerOf(req.Header)
+	enter(n)
 	// p_out("Setattr for %q in \n%q\n\n", req, n)
+	n.lock()
+	meta.Lock()
+	var err error
+	if inArchive(n) {
+		err = fuse.EPERM
+	} else {
+		err = n.setattrCheck(req, who)
+	}
+	meta.Unlock()
+	if err != nil {
+		n.unlock()
+		leave()
+		return err
+	}
+	if req.Valid.Size() {
+		if err := n.setSize(req.Size); err != nil {
+			n.unlock()
+			leave()
+			return err
+		}
+		n.flushData() // not buffered in any handle
+	}
+	meta.Lock()
 	// Setattr() should only be allowed to modify particular parts of a
 	if req.Valid.Mode() {
 		n.Attrs.Mode = req.Mode
+		if req.Header.Uid != 0 && !inGroup(who, n.Attrs.Gid) {
+			n.Attrs.Mode &^= os.ModeSetgid
+		}
+		n.syncACL(true)
+	}
+	if (req.Valid.Uid() && req.Uid != n.Attrs.Uid) || (req.Valid.Gid() && req.Gid != n.Attrs.Gid) {
+		if !n.Attrs.Mode.IsDir() {
+			n.Attrs.Mode &^= os.ModeSetuid | os.ModeSetgid
+		}
 	}
 	if req.Valid.Uid() {
 		n.Attrs.Uid = req.Uid
@@ -74,10 +218,6 @@ func (n *DNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fus
 	if req.Valid.Gid() {
 		n.Attrs.Gid = req.Gid
 	}
-	if req.Valid.Size() {
-		n.Attrs.Size = req.Size
-		n.data = n.data[:req.Size]
-	}
 	if req.Valid.Atime() {
 		n.Attrs.Atime = req.Atime
 	}
@@ -94,19 +234,55 @@ func (n *DNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fus
 		n.Attrs.Flags = req.Flags
 	}
 	resp.Attr = n.Attrs
+	meta.Unlock()
 
-	out()
+	n.unlock()
+	leave()
 	return nil
 }
 
 func (n *DNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-	in()
-	findDNode(n)
+	who := callerOf(req.Header)
+	enter(n)
 	p_out("Mkdir %q in \n%q\n\n", req, n)
+	if i := strings.Index(req.Name, "@"); i > 0 && !n.archive {
+		// as in p3, "mkdir name@versions" and "mkdir name@<time>" give
+		// the history views; n's kids aren't touched
+		meta.Lock()
+		_, ok := n.childSig(req.Name[:i])
+		meta.Unlock()
+		if ok {
+			v := n.historyView(req.Name)
+			leave()
+			if v == nil {
+				return nil, fuse.ENOENT
+			}
+			return v, nil
+		}
+	}
+	n.lock()
+	meta.Lock()
+	if inArchive(n) {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return nil, fuse.EPERM
+	}
+	if !canModifyDir(n, who) {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return nil, EACCES
+	}
 	d := new(DNode)
 	d.init(req.Name, req.Mode)
 	d.Attrs.Uid = req.Header.Uid
 	d.Attrs.Gid = req.Header.Gid
+	if n.Attrs.Mode&os.ModeSetgid != 0 { // BSD group semantics, passed down
+		d.Attrs.Gid = n.Attrs.Gid
+		d.Attrs.Mode |= os.ModeSetgid
+	}
+	d.inheritACL(n)
 	d.sig = shaString(Marshal(d))
 	d.parent = n
 	d.Parent = n.Attrs.Inode
@@ -115,36 +291,54 @@ func (n *DNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, err
 
 	nodeMap[d.Attrs.Inode] = d
 	markDirty(d)
+	meta.Unlock()
 
-	out()
+	n.unlock()
+	leave()
 	return d, nil
 }
 
 func (n *DNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	in()
-	findDNode(n)
+	enter(n)
 	p_out("Readdirall for %q\n\n", n)
+	n.rlock()
+	n.refreshSnapshots()
+	// SNAPDIR and the history views are left out on purpose: Lookup
+	// finds them, but find, du and rsync shouldn't walk every version
 	var dirDirs = []fuse.Dirent{}
-	for _, val := range n.kids {
-		dirDirs = append(dirDirs, addDirEnt(val))
+	meta.Lock()
+	for key, val := range n.kids {
+		dirDirs = append(dirDirs, addDirEnt(key, val))
 	}
-	for key, val := range n.ChildSigs {
+	unloaded := make(map[string]string)
+	for key := range n.ChildSigs {
 		if _, ok := n.kids[key]; !ok {
-			cn := getDNode(val)
-			if cn == nil {
-				if cn = getRemoteDNode(n.Owner, val); cn == nil {
-					continue
-				}
-			}
-			dirDirs = append(dirDirs, addDirEnt(cn))
+			unloaded[key], _ = n.childSig(key)
 		}
 	}
-	out()
+	owner := n.Owner
+	meta.Unlock()
+	for key, val := range unloaded {
+		cn := fetchDNode(owner, val)
+		if cn == nil {
+			// listed, but looking it up fails with EIO
+			p_err("Readdirall: %q in %q can't be fetched\n", key, n.Name)
+			dirDirs = append(dirDirs, fuse.Dirent{Name: key, Type: fuse.DT_Unknown})
+			continue
+		}
+		if n.archive {
+			cn.Attrs.Inode = 0
+		}
+		dirDirs = append(dirDirs, addDirEnt(key, cn))
+	}
+	n.runlock()
+	leave()
 	return dirDirs, nil
 }
 
-// helper function for adding directory entries
-func addDirEnt(n *DNode) fuse.Dirent {
+// helper function for adding directory entries; a linked file's Name is
+// only one of its names
+func addDirEnt(name string, n *DNode) fuse.Dirent {
 	typ := fuse.DT_Unknown
 	if n.Attrs.Mode.IsDir() {
 		typ = fuse.DT_Dir
@@ -157,15 +351,35 @@ func addDirEnt(n *DNode) fuse.Dirent {
 	if n.Attrs.Mode&os.ModeType == os.ModeSymlink {
 		typ = fuse.DT_Link
 	}
-	return fuse.Dirent{Inode: n.Attrs.Inode, Type: typ, Name: n.Name}
+	return fuse.Dirent{Inode: n.Attrs.Inode, Type: typ, Name: name}
 }
 
 func (n *DNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	in()
-	findDNode(n)
+	who := callerOf(req.Header)
+	enter(n)
 	// p_out("Create req: %q \nin %q\n\n", req, n)
+	n.lock()
+	meta.Lock()
+	if inArchive(n) {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return nil, nil, fuse.EPERM
+	}
+	if !canModifyDir(n, who) {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return nil, nil, EACCES
+	}
 	f := new(DNode)
 	f.init(req.Name, req.Mode)
+	f.Attrs.Uid = req.Header.Uid
+	f.Attrs.Gid = req.Header.Gid
+	if n.Attrs.Mode&os.ModeSetgid != 0 {
+		f.Attrs.Gid = n.Attrs.Gid
+	}
+	f.inheritACL(n)
 	f.sig = shaString(Marshal(f))
 	f.parent = n
 	f.Parent = n.Attrs.Inode
@@ -174,143 +388,348 @@ func (n *DNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.
 
 	nodeMap[f.Attrs.Inode] = f
 	markDirty(f)
+	meta.Unlock()
+	n.unlock()
 
-	out()
-	return f, f, nil
+	h := f.open(req.Flags)
+	leave()
+	return f, h, nil
 }
 
-func (n *DNode) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	in()
-	findDNode(n)
-	// p_out("Write req: %q\nin %q\n\n", req, n)
-	olen := uint64(len(n.data))
-	wlen := uint64(len(req.Data))
-	offset := uint64(req.Offset)
-	limit := offset + wlen
-
-	if limit > olen {
-		if n.Attrs.Size > uint64(len(n.data)) {
-			n.data = n.readall()
-		}
-		t := make([]byte, limit)
-		copy(t, n.data)
-		n.data = t
-		n.Attrs.Size = limit
+// The target is kept as given: relative, absolute or dangling.
+func (n *DNode) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	who := callerOf(req.Header)
+	enter(n)
+	p_out("Symlink %q -> %q in %q\n\n", req.NewName, req.Target, n)
+	n.lock()
+	meta.Lock()
+	arch, ok := inArchive(n), canModifyDir(n, who)
+	meta.Unlock()
+	if arch {
+		n.unlock()
+		leave()
+		return nil, fuse.EPERM
 	}
-	resp.Size = copy(n.data[offset:], req.Data)
-	n.dirty = true
-	markDirty(n)
+	if !ok {
+		n.unlock()
+		leave()
+		return nil, EACCES
+	}
+	if n.loadChild(req.NewName) != nil {
+		n.unlock()
+		leave()
+		return nil, fuse.EEXIST
+	}
+	meta.Lock()
+	l := new(DNode)
+	l.init(req.NewName, os.ModeSymlink|0777)
+	l.Attrs.Uid = req.Header.Uid
+	l.Attrs.Gid = req.Header.Gid
+	l.Attrs.Size = uint64(len(req.Target))
+	l.Target = req.Target
+	l.sig = shaString(Marshal(l))
+	l.parent = n
+	l.Parent = n.Attrs.Inode
+
+	n.kids[req.NewName] = l
+
+	nodeMap[l.Attrs.Inode] = l
+	markDirty(l)
+	meta.Unlock()
+
+	n.unlock()
+	leave()
+	return l, nil
+}
 
-	out()
-	return nil
+func (n *DNode) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	enter(n)
+	meta.Lock()
+	isLink, target := n.Attrs.Mode&os.ModeType == os.ModeSymlink, n.Target
+	meta.Unlock()
+	leave()
+	if !isLink {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return target, nil
 }
 
-func (n *DNode) ReadAll(ctx context.Context) (b []byte, e error) {
-	in()
-	findDNode(n)
-	p_out("Readall: %q\n\n", n)
-	b = n.readall()
-	n.data = b
-	out()
-	return b, nil
+// Returns the chunk lengths, fetching every chunk once for DNodes written
+// before BlockLens was recorded. Caller holds n's inode lock, exclusively
+// unless they're already there. Chunks that can't be fetched count as
+// empty, and reading them fails, until they can be.
+func (n *DNode) blockLens() []uint64 {
+	if len(n.BlockLens) == len(n.DataBlocks) {
+		return n.BlockLens
+	}
+	all := make([]int, len(n.DataBlocks))
+	for i := range all {
+		all[i] = i
+	}
+	lens := make([]uint64, len(n.DataBlocks))
+	missing := false
+	for i, blk := range n.fetchBlocks(all) {
+		lens[i] = uint64(len(blk))
+		missing = missing || blk == nil
+	}
+	if missing {
+		return lens
+	}
+	n.BlockLens = lens
+	n.extOff = nil
+	return lens
 }
 
-func (n *DNode) readall() (b []byte) {
-	for _, dblk := range n.DataBlocks {
-		if n.Owner != Merep.Pid {
-			p_out("Requesting block %s from %d\n", dblk, n.Owner)
-			var enc_reply []byte
-			req := prepare_request(dblk, Merep.Pid)
-			Clients[n.Owner].Call("Node.ReqData", req, &enc_reply)
-			p_out("enc_reply: [%s]\n", sha256bytesToString(enc_reply))
-
-			reply := accept_response(enc_reply)
-			if reply.Ack {
-				b = append(b, reply.Block...)
-			} else {
-				p_err("Block request %s to %d failed\n", dblk, n.Owner)
-			}
-		} else {
-			b = append(b, getBlock(dblk)...)
+// Fetches the chunks at the given DataBlocks indices, in parallel if
+// they're not local (see fetchRemote). Missing chunks come back nil.
+func (n *DNode) fetchBlocks(idx []int) [][]byte {
+	blks := make([][]byte, len(idx))
+	var wg sync.WaitGroup
+	for j, i := range idx {
+		dblk := n.DataBlocks[i]
+		if blks[j] = getBlock(dblk); blks[j] != nil {
+			continue
 		}
+		wg.Add(1)
+		go func(j int, dblk string) {
+			defer wg.Done()
+			blks[j] = fetchRemote("Node.ReqData", n.Owner, dblk)
+		}(j, dblk)
 	}
-	return
+	wg.Wait()
+	return blks
 }
 
-func (n *DNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
-	in()
-	// p_out("fsync for %q\n\n", n)
-	out()
+// Asks the owner for a block, or DNode, we don't have, then if it's
+// unreachable or hasn't got it, every other replica in turn: they're
+// content-addressed, so anyone's copy will do once its hash checks out.
+// What we get is kept here too. nil if nobody has it.
+func fetchRemote(method string, owner int, sig string) []byte {
+	pids := []int{owner}
+	for pid := range clients() {
+		if pid != owner {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids[1:])
+	for _, pid := range pids {
+		blk := reqBlock(pid, method, sig)
+		if blk == nil {
+			continue
+		}
+		if shaString(blk) != sig {
+			p_err("Block %s from %d doesn't match its hash, trying elsewhere\n", sig, pid)
+			stats.badFetch()
+			continue
+		}
+		if pid != owner {
+			p_out("Block %s from %d, not its owner %d\n", sig, pid, owner)
+		}
+		putBlock(blk)
+		return blk
+	}
 	return nil
 }
 
-func (n *DNode) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	in()
-	findDNode(n)
-	p_out("Flush %q \nin %q\n\n", req, n)
-	if n.dirty {
-		n.Attrs.Atime = time.Now()
-		n.Attrs.Mtime = time.Now()
-		n.DataBlocks = putBlocks(n.data)
-		n.Owner = Merep.Pid
-		n.sig = shaString(Marshal(n))
+// The block from one replica, by method (Node.ReqData, or Node.ReqDNode
+// for DNodes); nil if it's unreachable or hasn't got it.
+// Only asks replicas we're connected to, as the FUSE side calls it with
+// the tree lock held (see callUp); the background work that fetches
+// connects first.
+func reqBlock(pid int, method, dblk string) []byte {
+	c, ok := clients()[pid]
+	if !ok {
+		return nil
+	}
+	p_out("Requesting block %s from %d\n", dblk, pid)
+	var enc_reply []byte
+	req := prepare_request(dblk, Merep.Pid)
+	if err := c.callUp(method, req, &enc_reply); err != nil {
+		p_err("Block request %s to %d: %v\n", dblk, pid, err)
+		return nil
+	}
+	p_out("enc_reply: [%s]\n", sha256bytesToString(enc_reply))
 
-		n.dirty = false
+	reply := accept_response(enc_reply)
+	if !reply.Ack {
+		p_out("Block request %s to %d failed\n", dblk, pid)
+		return nil
+	}
+	if reply.Block == nil && reply.DN != nil {
+		// older replicas' ReqDNode only sends the decoded node
+		return Marshal(reply.DN)
+	}
+	return reply.Block
+}
+
+// Chunks whatever is buffered, as the last close would, and flushes it
+// to WriteQuorum replicas.
+func (n *DNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	enter(n)
+	// p_out("fsync for %q\n\n", n)
+	n.lock()
+	n.flushData()
+	n.unlock()
+	flushRoot()
+	leave()
+	if _, ok := sendOutbox(); !ok {
+		p_err("fsync %q: not on %d replicas yet\n", n.Name, WriteQuorum)
+		return fuse.EIO
 	}
-	out()
 	return nil
 }
 
 func (n *DNode) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
-	in()
-	findDNode(n)
+	who := callerOf(req.Header)
+	enter(n)
+	n.lock()
+	c := n.loadChild(req.Name)
+	meta.Lock()
+	if inArchive(n) {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return fuse.EPERM
+	}
+	if !canModifyDir(n, who) || !stickyOK(n, c, who) {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return EACCES
+	}
+	meta.Unlock()
 	err = fuse.ENOENT
 	// p_out("Remove %q from \n%q \n\n", req, n)
 	// If the DNode exists...delete it.
-	nid := -1
-	if val, ok := n.kids[req.Name]; ok {
-		nid = int(val.Attrs.Inode)
-		delete(n.kids, req.Name)
+	if n.unlink(req.Name) {
 		err = nil
 	}
-	if _, ok := n.ChildSigs[req.Name]; ok {
-		delete(n.ChildSigs, req.Name)
-		err = nil
+	n.unlock()
+	leave()
+	return
+}
+
+// Link another name to old, in n. Directories can't be linked.
+func (n *DNode) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	who := callerOf(req.Header)
+	enter(n)
+	f, ok := old.(*DNode)
+	if !ok {
+		leave()
+		return nil, fuse.EIO
 	}
-	if err == nil {
-		markDirty(n)
-		if nid >= 0 {
-			if _, ok := nodeMap[uint64(nid)]; ok {
-				nodeMap[uint64(nid)] = nil
-			}
+	n.lock()
+	if n.loadChild(req.NewName) != nil {
+		n.unlock()
+		leave()
+		return nil, fuse.EEXIST
+	}
+	meta.Lock()
+	if inArchive(n) || inArchive(f) || f.Attrs.Mode.IsDir() {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return nil, fuse.EPERM
+	}
+	if !canModifyDir(n, who) {
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return nil, EACCES
+	}
+	if nodeMap[f.Attrs.Inode] != f { // removed meanwhile
+		meta.Unlock()
+		n.unlock()
+		leave()
+		return nil, fuse.ENOENT
+	}
+	ref := inoRef(f.Attrs.Inode)
+	if root.Inodes == nil {
+		root.Inodes = make(map[uint64]string)
+	}
+	if _, ok := root.Inodes[f.Attrs.Inode]; !ok {
+		// first extra link: its one entry moves to the table. Only the
+		// ref changes, not the names, so f.parent needn't be locked:
+		// live ChildSigs are only read or written with meta held
+		// (flushNode marshals, and ReadDirAll copies, under it), and
+		// f.parent and f.Name are read under it here, so a rename of f
+		// is seen whole or not at all.
+		root.Inodes[f.Attrs.Inode] = f.sig
+		if f.parent != nil {
+			f.parent.ChildSigs[f.Name] = ref
 		}
 	}
-	out()
-	return
+	f.Attrs.Nlink++
+	f.Attrs.Ctime = time.Now()
+	n.kids[req.NewName] = f
+	n.ChildSigs[req.NewName] = ref
+	markDirty(n)
+	markDirty(f)
+	root.metaDirty = true
+	meta.Unlock()
+
+	n.unlock()
+	leave()
+	return f, nil
 }
 
 func (n *DNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
-	in()
-	findDNode(n)
+	who := callerOf(req.Header)
+	enter(n)
 	if outDir, ok := newDir.(*DNode); ok {
+		meta.Lock()
+		arch := inArchive(n) || inArchive(outDir)
+		meta.Unlock()
+		if arch {
+			leave()
+			return fuse.EPERM
+		}
 		// p_out("Rename: \nreq: %q \nn: %q \nnew: %q\n\n", req, n, outDir)
+		lockDirs(n, outDir)
 
-		if child, ok := n.kids[req.OldName]; ok {
+		child := n.loadChild(req.OldName)
+		if child == nil {
+			unlockDirs(n, outDir)
+			leave()
+			return fuse.ENOENT
+		}
+		target := outDir.loadChild(req.NewName)
+		meta.Lock()
+		ok := canModifyDir(n, who) && canModifyDir(outDir, who) &&
+			stickyOK(n, child, who) && stickyOK(outDir, target, who)
+		meta.Unlock()
+		if !ok {
+			unlockDirs(n, outDir)
+			leave()
+			return EACCES
+		}
+		if target == child {
+			unlockDirs(n, outDir)
+			leave()
+			return nil // same file already
+		} else if target != nil {
+			outDir.unlink(req.NewName)
+		}
+		meta.Lock()
+		if !n.isLink(req.OldName, child) {
 			child.Name = req.NewName
-			outDir.kids[req.NewName] = child
-			delete(n.kids, req.OldName)
-		} else {
-			outDir.ChildSigs[req.NewName] = n.ChildSigs[req.OldName]
-			outDir.kids[req.NewName] = getDNode(n.ChildSigs[req.OldName])
+			child.parent = outDir
+			child.Parent = outDir.Attrs.Inode
 		}
-
+		outDir.kids[req.NewName] = child
+		if ref, ok := n.ChildSigs[req.OldName]; ok {
+			outDir.ChildSigs[req.NewName] = ref
+		}
+		delete(n.kids, req.OldName)
 		delete(n.ChildSigs, req.OldName)
 		markDirty(n)
 		markDirty(outDir.kids[req.NewName])
+		meta.Unlock()
 
-		out()
+		unlockDirs(n, outDir)
+		leave()
 		return nil
 	}
-	out()
+	leave()
 	return fuse.ENOENT
 }
@@ -0,0 +1,170 @@
+package dfs
+
+import (
+	"fmt"
+	"sync"
+)
+
+//=============================================================================
+// Mark and sweep of unreachable blocks.
+//
+// Every flush writes new DNodes and nothing is ever overwritten, so the
+// store only grows. gc() marks the DNodes and data blocks reachable from
+// head.Root and the snapshots (and, keeping history, from every older
+// root on its PrevSig chain), and the blocks pinned by receives in
+// progress, and deletes every other block. Metadata keys ("head" etc.) are
+// never touched.
+//
+// Older versions of a file or directory are reachable through the older
+// roots that contain them, so only the root's PrevSig chain is followed.
+// A node's own PrevSig chain isn't: versions that only roots retention
+// dropped had are freed, and the history views (history.go) stop at the
+// first one that's gone.
+
+type gcResult struct {
+	Roots   int
+	Marked  int
+	Deleted int
+	Freed   uint64
+}
+
+func (r gcResult) String() string {
+	return fmt.Sprintf("gc: %d roots, %d blocks live, %d deleted (%d bytes)\n",
+		r.Roots, r.Marked, r.Deleted, r.Freed)
+}
+
+// Root signatures to keep: the current root, every snapshot and, with
+// history, the current root's predecessors.
+func gcRoots(history bool) (roots []string) {
+	if history {
+		for _, v := range rootHistory() {
+			roots = append(roots, v.sig)
+		}
+	}
+	if len(roots) == 0 && head.Root != "" {
+		roots = append(roots, head.Root)
+	}
+	have := make(map[string]bool)
+	for _, sig := range roots {
+		have[sig] = true
+	}
+	for sig := range pinnedRoots() {
+		if !have[sig] {
+			roots = append(roots, sig)
+		}
+	}
+	return
+}
+
+// Blocks a receive has fetched or found here but not applied yet (see
+// receiveNode): they're unreachable until it has, so gc keeps them.
+var pins struct {
+	sync.Mutex
+	count map[string]int
+}
+
+func pin(sigs []string) {
+	pins.Lock()
+	if pins.count == nil {
+		pins.count = make(map[string]int)
+	}
+	for _, sig := range sigs {
+		pins.count[sig]++
+	}
+	pins.Unlock()
+}
+
+func unpin(sigs []string) {
+	pins.Lock()
+	for _, sig := range sigs {
+		if pins.count[sig]--; pins.count[sig] <= 0 {
+			delete(pins.count, sig)
+		}
+	}
+	pins.Unlock()
+}
+
+func markTree(sig string, live map[string]bool) {
+	if !isSig(sig) || live[sig] {
+		return
+	}
+	live[sig] = true
+	n := getDNode(sig)
+	if n == nil {
+		return // owned elsewhere
+	}
+	for _, dblk := range n.DataBlocks {
+		if dblk != "" { // holes
+			live[dblk] = true
+		}
+	}
+	for _, csig := range n.ChildSigs {
+		markTree(csig, live) // hard links are marked through Inodes
+	}
+	for _, fsig := range n.Inodes {
+		markTree(fsig, live)
+	}
+}
+
+// Must be called with the lock held, or on an unmounted store.
+func gc(history, dryRun bool) (res gcResult, err error) {
+	if root != nil && root.metaDirty {
+		flushRoot()
+	}
+
+	live := make(map[string]bool)
+	roots := gcRoots(history)
+	for _, sig := range roots {
+		markTree(sig, live)
+	}
+	pins.Lock()
+	for sig := range pins.count {
+		live[sig] = true
+	}
+	pins.Unlock()
+	res.Roots = len(roots)
+	res.Marked = len(live)
+
+	var dead []string
+	err = db.Keys("", func(key string, size int) bool {
+		if isSig(key) && !live[key] {
+			dead = append(dead, key)
+			res.Freed += uint64(size)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+	res.Deleted = len(dead)
+	if dryRun {
+		return
+	}
+	for _, key := range dead {
+		if err = db.Delete(key); err != nil {
+			return
+		}
+	}
+	p_out("%s", res)
+	return
+}
+
+// "gc [-current] [-n]": -current drops all history, -n only reports
+func cmdGC(args []string) (string, error) {
+	history, dryRun := true, false
+	for _, a := range args {
+		switch a {
+		case "-current":
+			history = false
+		case "-n":
+			dryRun = true
+		default:
+			return "", fmt.Errorf("usage: %s", commands["gc"].usage)
+		}
+	}
+	res, err := gc(history, dryRun)
+	if dryRun {
+		return "(dry run) " + res.String(), err
+	}
+	return res.String(), err
+}
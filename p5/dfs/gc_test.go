@@ -0,0 +1,101 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// After prune and gc free the versions in between, the history views
+// stop at the gap instead of returning the wrong version.
+func TestHistoryStopsAtFreedVersions(t *testing.T) {
+	f := newSparseFile(t)
+	ctx := context.Background()
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		f.write(0, noise(int64(i), 5000))
+		f.flush()
+		flushRoot()
+		times = append(times, time.Now())
+		time.Sleep(20 * time.Millisecond)
+	}
+	lookup := func(name string) *DNode {
+		n, err := root.Lookup(ctx, &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+		if err != nil {
+			return nil
+		}
+		return n.(*DNode)
+	}
+	tm := times[0].Format("2006-1-2 15:04:05")
+	if v := lookup("f@versions"); v == nil || len(v.kids) != 3 {
+		t.Fatal("versions before gc", v)
+	}
+
+	r, _ := ParseRetention("1")
+	if dropped := r.prune(time.Now(), false); dropped == 0 {
+		t.Fatal("nothing pruned")
+	}
+	if _, err := gc(true, false); err != nil {
+		t.Fatal(err)
+	}
+	v := lookup("f@versions")
+	if v == nil || len(v.kids) != 1 {
+		t.Fatal("versions after gc", v)
+	}
+	for _, k := range v.kids {
+		if len(k.DataBlocks) == 0 || !db.Has(k.DataBlocks[0]) {
+			t.Fatal("listed a version whose data is gone")
+		}
+	}
+	if old := lookup("f@" + tm); old != nil {
+		t.Fatalf("f@%s found %d bytes, want nothing", tm, old.Attrs.Size)
+	}
+	if cur := lookup("f@-0s"); cur == nil {
+		t.Fatal("current version gone")
+	}
+}
+
+// A block a receive has fetched survives a gc that runs before the
+// receive applies it.
+func TestGCKeepsReceivedBlocks(t *testing.T) {
+	testFS(t)
+	peer := &blockPeer{blocks: make(map[string][]byte), hold: make(map[string]chan bool)}
+	serveReplica(t, peer)
+	n := createFile(t, "f", noise(1, 1000))
+	data := noise(2, 64<<10)
+	theirs := remoteEdit(n.sig, data)
+	for _, sig := range theirs.DataBlocks {
+		peer.blocks[sig] = getBlock(sig)
+		db.Delete(sig)
+	}
+	first, last := theirs.DataBlocks[0], theirs.DataBlocks[len(theirs.DataBlocks)-1]
+	release := make(chan bool)
+	peer.hold[last] = release
+
+	acked := make(chan bool)
+	go func() { acked <- receiveNode(theirs) }()
+	for !db.Has(first) {
+		time.Sleep(time.Millisecond)
+	}
+	in()
+	_, err := gc(true, false)
+	out()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if !<-acked {
+		t.Fatal("not applied")
+	}
+	for _, sig := range theirs.DataBlocks {
+		if !db.Has(sig) {
+			t.Fatalf("block %s gone", sig)
+		}
+	}
+	if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes back", len(got))
+	}
+}
@@ -0,0 +1,236 @@
+package dfs
+
+import (
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+)
+
+//=============================================================================
+// Open files. Every open(2) of a file gets its own Handle; directories are
+// their own handle.
+//
+// Writes from every handle go into the file's windows (see sparse.go),
+// under its inode lock, so they land as they would on a local disk. A
+// handle's writes are chunked and become the file's new version when it's
+// closed (Flush) or released, so whoever opens the file after that sees
+// them: close-to-open, as in NFS. The windows go once they're chunked,
+// which a long write doesn't wait for: past MAXWINDOW bytes of them, it
+// flushes as it goes.
+
+const MAXWINDOW = 4 << 20
+
+type Handle struct {
+	n     *DNode
+	flags fuse.OpenFlags
+	wrote bool // written since the last Flush, guarded by n's inode lock
+}
+
+var EBADF = fuse.Errno(syscall.EBADF)
+
+// A new handle on n, truncating it first for O_TRUNC.
+func (n *DNode) open(flags fuse.OpenFlags) *Handle {
+	h := &Handle{n: n, flags: flags}
+	n.lock()
+	n.opens++
+	if flags&fuse.OpenTruncate != 0 && !flags.IsReadOnly() && n.Attrs.Size > 0 {
+		n.setSize(0)
+		h.wrote = true
+	}
+	n.unlock()
+	return h
+}
+
+// Sets n's size, adding a hole or dropping the end. Caller holds n's
+// inode lock. Only truncating to 0 works without the chunk lengths.
+func (n *DNode) setSize(size uint64) error {
+	if err := n.loadLayout(); err != nil {
+		if size > 0 {
+			return err
+		}
+		n.setExtents(nil, nil) // all going anyway
+		n.wins = nil
+	}
+	n.fitExtents()
+	if size > n.Attrs.Size {
+		n.growExtents(size - n.Attrs.Size)
+	} else {
+		n.cutExtents(size)
+	}
+	n.dirty = true
+	meta.Lock()
+	n.Attrs.Size = size
+	markDirty(n)
+	meta.Unlock()
+	return nil
+}
+
+// Chunks the windows, if anything's changed, and points n at the new
+// blocks. Caller holds n's inode lock.
+func (n *DNode) flushData() {
+	if !n.dirty {
+		return
+	}
+	sigs, lens := n.rechunk()
+	meta.Lock()
+	n.Attrs.Atime = time.Now()
+	n.Attrs.Mtime = time.Now()
+	n.setExtents(sigs, lens)
+	n.Owner = Merep.Pid
+	n.sig = shaString(Marshal(n))
+	meta.Unlock()
+
+	n.wins = nil
+	n.dirty = false
+}
+
+// With O_APPEND every write goes at the end as it is now, whatever
+// offset the kernel thought it was.
+func (h *Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n := h.n
+	enter(n)
+	// p_out("Write req: %q\nin %q\n\n", req, n)
+	if h.flags.IsReadOnly() {
+		leave()
+		return EBADF
+	}
+	n.lock()
+	meta.Lock()
+	arch := inArchive(n)
+	meta.Unlock()
+	if arch {
+		n.unlock()
+		leave()
+		return fuse.EPERM
+	}
+	if err := n.loadLayout(); err != nil {
+		n.unlock()
+		leave()
+		return err
+	}
+	oldSize := n.Attrs.Size
+	n.fitExtents()
+	wlen := uint64(len(req.Data))
+	offset := uint64(req.Offset)
+	if h.flags&fuse.OpenAppend != 0 {
+		offset = oldSize
+	}
+	limit := offset + wlen
+	if wlen == 0 {
+		n.unlock()
+		leave()
+		return nil
+	}
+	if limit > oldSize {
+		n.growExtents(limit - oldSize)
+	}
+
+	// the last chunk was cut short by the end of the file, so appending
+	// redoes it
+	lo := offset
+	if offset == oldSize && oldSize > 0 {
+		lo = oldSize - 1
+	}
+	w, err := n.window(lo, limit)
+	if err != nil {
+		n.unlock()
+		leave()
+		return err
+	}
+	resp.Size = copy(w.data[offset-w.off:], req.Data)
+	w.mark(offset, limit)
+	n.dirty = true
+
+	meta.Lock()
+	if limit > n.Attrs.Size {
+		n.Attrs.Size = limit
+	}
+	markDirty(n)
+	meta.Unlock()
+	h.wrote = true
+	if n.windowed() > MAXWINDOW {
+		n.flushData()
+	}
+
+	n.unlock()
+	leave()
+	return nil
+}
+
+// Only the chunks overlapping [Offset, Offset+Size) are fetched; holes
+// read as zeros. Data still in windows is served from memory.
+func (h *Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	n := h.n
+	enter(n)
+	p_out("Read %q\n\n", req)
+	if h.flags.IsWriteOnly() {
+		leave()
+		return EBADF
+	}
+	n.rlock()
+	if !n.layoutReady() {
+		n.runlock()
+		n.lock()
+		err := n.loadLayout()
+		n.unlock()
+		if err != nil {
+			leave()
+			return err
+		}
+		n.rlock()
+	}
+	off := uint64(req.Offset)
+	end := off + uint64(req.Size)
+	if end > n.Attrs.Size {
+		end = n.Attrs.Size
+	}
+	if off >= end {
+		n.runlock()
+		leave()
+		return nil
+	}
+	data, err := n.readRange(off, end)
+	n.runlock()
+	leave()
+	if err != nil {
+		return err
+	}
+	resp.Data = data
+	return nil
+}
+
+// Called on every close(2) of a descriptor for the handle.
+func (h *Handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	n := h.n
+	enter(n)
+	p_out("Flush %q \nin %q\n\n", req, n)
+	n.lock()
+	if h.wrote {
+		n.flushData()
+		h.wrote = false
+	}
+	n.unlock()
+	leave()
+	return nil
+}
+
+// The last close of the handle; writes through mmap may not have been
+// flushed yet.
+func (h *Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	n := h.n
+	enter(n)
+	n.lock()
+	if h.wrote {
+		n.flushData()
+		h.wrote = false
+	}
+	if n.opens > 0 {
+		n.opens--
+	}
+	n.unlock()
+	leave()
+	return nil
+}
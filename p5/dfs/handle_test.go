@@ -0,0 +1,129 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+func open(t *testing.T, n *DNode, flags fuse.OpenFlags) *Handle {
+	t.Helper()
+	h, err := n.Open(context.Background(), &fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*Handle)
+}
+
+func closeHandle(h *Handle) {
+	ctx := context.Background()
+	h.Flush(ctx, &fuse.FlushRequest{})
+	h.Release(ctx, &fuse.ReleaseRequest{})
+}
+
+func TestHandleModes(t *testing.T) {
+	testFS(t)
+	ctx := context.Background()
+	data := noise(1, 3000)
+	n := createFile(t, "f", data)
+
+	h := open(t, n, fuse.OpenReadOnly)
+	if err := h.Write(ctx, &fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{}); err != EBADF {
+		t.Fatalf("write to a read-only handle: %v", err)
+	}
+	closeHandle(h)
+	h = open(t, n, fuse.OpenWriteOnly)
+	if err := h.Read(ctx, &fuse.ReadRequest{Size: 10}, &fuse.ReadResponse{}); err != EBADF {
+		t.Fatalf("read from a write-only handle: %v", err)
+	}
+	closeHandle(h)
+
+	// O_APPEND writes at the end, whatever the offset
+	more := noise(2, 500)
+	h = open(t, n, fuse.OpenWriteOnly|fuse.OpenAppend)
+	for _, half := range [][]byte{more[:250], more[250:]} {
+		if err := h.Write(ctx, &fuse.WriteRequest{Data: half}, &fuse.WriteResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeHandle(h)
+	data = append(data, more...)
+	if got := contents(t, n); !bytes.Equal(got, data) {
+		t.Fatalf("appended: read %d bytes, first difference at %d", len(got), firstDiff(got, data))
+	}
+
+	// O_TRUNC empties it, but not when opened read-only
+	closeHandle(open(t, n, fuse.OpenReadOnly|fuse.OpenTruncate))
+	if got := contents(t, n); !bytes.Equal(got, data) {
+		t.Fatalf("read-only O_TRUNC left %d bytes", len(got))
+	}
+	sig := n.sig
+	closeHandle(open(t, n, fuse.OpenReadWrite|fuse.OpenTruncate))
+	if n.Attrs.Size != 0 || len(contents(t, n)) != 0 || n.sig == sig {
+		t.Fatalf("O_TRUNC left %d bytes", n.Attrs.Size)
+	}
+	flushRoot()
+	restart()
+	if n = lookup(t, root, "f"); n.Attrs.Size != 0 {
+		t.Fatalf("truncated to %d bytes after a restart", n.Attrs.Size)
+	}
+}
+
+// Handles share the file's data, but only a handle's close makes what it
+// wrote the file's version.
+func TestCloseToOpen(t *testing.T) {
+	testFS(t)
+	ctx := context.Background()
+	n := createFile(t, "f", noise(1, 2000))
+	sig := n.sig
+	a, b := open(t, n, fuse.OpenReadWrite), open(t, n, fuse.OpenReadWrite)
+	data := noise(2, 5000)
+	if err := a.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	resp := &fuse.ReadResponse{}
+	if err := b.Read(ctx, &fuse.ReadRequest{Size: 10000}, resp); err != nil || !bytes.Equal(resp.Data, data) {
+		t.Fatalf("other handle read %d bytes: %v", len(resp.Data), err)
+	}
+	closeHandle(b)
+	if n.sig != sig {
+		t.Fatal("closing a handle that didn't write made a version")
+	}
+	closeHandle(a)
+	if n.sig == sig {
+		t.Fatal("closing the writer made no version")
+	}
+	flushRoot()
+	restart()
+	if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, data) {
+		t.Fatalf("opened after close: read %d bytes, first difference at %d", len(got), firstDiff(got, data))
+	}
+}
+
+// A long write is chunked as it goes, so what it holds in memory stays
+// bounded.
+func TestWindowBounded(t *testing.T) {
+	f := newSparseFile(t)
+	const piece = 64 << 10
+	most := 0
+	for off := 0; off < 3*MAXWINDOW; off += piece {
+		f.write(off, noise(int64(off), piece))
+		f.n.lock()
+		if l := f.n.windowed(); l > most {
+			most = l
+		}
+		f.n.unlock()
+	}
+	if most > MAXWINDOW+piece+2*MAXCHUNK {
+		t.Fatalf("windows grew to %d bytes", most)
+	}
+	f.check("written")
+	f.flush()
+	flushRoot()
+	restart()
+	if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, f.want) {
+		t.Fatalf("read %d bytes back, first difference at %d", len(got), firstDiff(got, f.want))
+	}
+}
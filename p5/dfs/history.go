@@ -0,0 +1,164 @@
+package dfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+//=============================================================================
+// Read-only views of history. None of these are ever put in a live
+// directory's kids, so browsing history doesn't change the file system.
+//
+//	name@versions   every stored version of name
+//	name@<time>     name as of an absolute time, or relative ("@-70s")
+//	.snapshots/     every flushed version of the directory (for the root,
+//	                every version of the file system, and the named
+//	                snapshots), named by time and Version. Not listed,
+//	                only looked up, so find and rsync don't wander into it.
+
+const SNAPDIR = ".snapshots"
+
+// An empty read-only directory that isn't in nodeMap.
+func virtualDir(name string, parent *DNode) *DNode {
+	now := time.Now()
+	d := &DNode{
+		Name:      name,
+		ChildSigs: make(map[string]string),
+		Owner:     Merep.Pid,
+		archive:   true,
+		parent:    parent,
+		kids:      make(map[string]*DNode),
+	}
+	d.Attrs = fuse.Attr{
+		Valid:  1 * time.Second,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Crtime: now,
+		Mode:   os.ModeDir | 0555,
+		Nlink:  2,
+		Uid:    uid,
+		Gid:    gid,
+	}
+	return d
+}
+
+// Follows the PrevSig chain from sig, one entry per version, named by
+// name(). Versions not stored here are fetched from their owner; the
+// list stops at one nobody has (see gc.go).
+func versionKids(sig string, owner int, parent *DNode, name func(v *DNode) string) map[string]*DNode {
+	m := make(map[string]*DNode)
+	for sig != "" {
+		v := fetchDNode(owner, sig)
+		if v == nil {
+			break
+		}
+		v.Name = name(v)
+		if _, ok := m[v.Name]; ok {
+			v.Name = fmt.Sprintf("%s#%d", v.Name, v.Version)
+		}
+		v.sig = sig
+		v.Attrs.Inode = 0
+		v.archive = true
+		v.parent = parent
+		m[v.Name] = v
+		sig, owner = v.PrevSig, v.Owner
+	}
+	return m
+}
+
+// The name@versions or name@<time> view of child name, or nil.
+func (n *DNode) historyView(name string) *DNode {
+	split := strings.SplitN(name, "@", 2)
+	if len(split) < 2 {
+		return nil
+	}
+	meta.Lock()
+	csig, ok := n.childSig(split[0])
+	owner := n.Owner
+	meta.Unlock()
+	if !ok {
+		return nil
+	}
+	cur := fetchDNode(owner, csig)
+	if cur == nil {
+		return nil
+	}
+
+	if split[1] == "versions" {
+		d := virtualDir(name, n)
+		d.kids = versionKids(csig, owner, d, func(v *DNode) string {
+			return fmt.Sprintf("%s.%s", v.Name, v.Attrs.Atime.Format("2006-1-2 15:04:05"))
+		})
+		return d
+	}
+
+	tm, ok := peteTime(split[1])
+	if !ok {
+		td, err := time.ParseDuration(split[1])
+		if err != nil {
+			return nil
+		}
+		tm = time.Now().Add(td)
+		p_out("now: %s, tm: %s\n", time.Now(), tm)
+	}
+	cur.sig = csig
+	tN := cur.timeTravel(tm)
+	if tN == nil {
+		return nil
+	}
+	tN.Name = name
+	tN.Attrs.Inode = 0
+	tN.metaDirty = false
+	tN.archive = true
+	tN.parent = n
+	return tN
+}
+
+func (n *DNode) snapshotsDir() *DNode {
+	d := virtualDir(SNAPDIR, n)
+	d.snaps = n
+	d.refreshSnapshots()
+	return d
+}
+
+// For a .snapshots directory, relist the versions if there are new ones.
+func (n *DNode) refreshSnapshots() {
+	if n.snaps == nil {
+		return
+	}
+	meta.Lock()
+	start, owner := n.snaps.sig, n.snaps.Owner
+	if n.snaps == root {
+		start = head.Root
+	}
+	fresh := start == n.sig && (n.snaps != root || n.snapGen == snapGen)
+	meta.Unlock()
+	if fresh {
+		return
+	}
+	kids := versionKids(start, owner, n, func(v *DNode) string {
+		return fmt.Sprintf("%s_v%d", v.Attrs.Atime.Format("2006-01-02T15:04:05"), v.Version)
+	})
+	if n.snaps == root {
+		for _, s := range snapshots {
+			if v := getDNode(s.Root); v != nil {
+				v.Name = s.Name
+				v.sig = s.Root
+				v.Attrs.Inode = 0
+				v.archive = true
+				v.parent = n
+				kids[v.Name] = v
+			}
+		}
+	}
+	meta.Lock()
+	n.sig = start
+	n.kids = kids
+	n.snapGen = snapGen
+	meta.Unlock()
+}
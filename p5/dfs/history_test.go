@@ -0,0 +1,112 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// p3's mkdir name@... and the lookups give the same views, and neither
+// adds anything to the directory.
+func TestMkdirHistory(t *testing.T) {
+	f := newSparseFile(t)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		f.write(0, noise(int64(i), 3000))
+		f.flush()
+		flushRoot()
+	}
+	mkdir := func(name string) (*DNode, error) {
+		n, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: name, Mode: 0755})
+		if err != nil {
+			return nil, err
+		}
+		return n.(*DNode), nil
+	}
+	v, err := mkdir("f@versions")
+	if err != nil || len(v.kids) != 2 || !v.archive {
+		t.Fatal("mkdir f@versions", v, err)
+	}
+	l, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "f@versions"}, &fuse.LookupResponse{})
+	if err != nil || len(l.(*DNode).kids) != len(v.kids) {
+		t.Fatal("lookup f@versions", l, err)
+	}
+	if cur, err := mkdir("f@-0s"); err != nil || cur.Attrs.Size != 3000 || !cur.archive {
+		t.Fatal("mkdir f@-0s", cur, err)
+	}
+	if _, err := mkdir("f@yesterday-ish"); err != fuse.ENOENT {
+		t.Fatal("bad time:", err)
+	}
+	if _, err := mkdir("user@host"); err != nil {
+		t.Fatal("plain name with @:", err)
+	}
+	for name := range root.kids {
+		if name != "f" && name != "user@host" {
+			t.Fatal("history view left in the directory:", name)
+		}
+	}
+}
+
+// Versions that aren't stored here are fetched from the replica that
+// has them, nodes with ReqDNode and their data with ReqData.
+func TestRemoteHistory(t *testing.T) {
+	f := newSparseFile(t)
+	peer := &blockPeer{blocks: make(map[string][]byte)}
+	serveReplica(t, peer)
+	var data [][]byte
+	for i := 0; i < 3; i++ {
+		data = append(data, noise(int64(i), 3000))
+		f.write(0, data[i])
+		f.flush()
+		flushRoot()
+	}
+	// all but the current version are only on replica 2
+	moved := make(map[string]bool)
+	var nodes []string
+	for sig := f.n.PrevSig; sig != ""; {
+		nodes = append(nodes, sig)
+		old := getDNode(sig)
+		for _, s := range append([]string{sig}, old.DataBlocks...) {
+			peer.blocks[s] = getBlock(s)
+			db.Delete(s)
+			moved[s] = true
+		}
+		sig = old.PrevSig
+	}
+
+	v := lookup(t, root, "f@versions")
+	if len(v.kids) != 3 {
+		t.Fatalf("%d versions, want 3", len(v.kids))
+	}
+	asked := make(map[string]bool)
+	for _, sig := range peer.dnodes {
+		if !moved[sig] {
+			t.Fatalf("asked for %s, which is here", sig)
+		}
+		asked[sig] = true
+		delete(moved, sig)
+	}
+	for _, sig := range nodes {
+		if !asked[sig] {
+			t.Fatalf("version %s not fetched with ReqDNode", sig)
+		}
+	}
+	for _, k := range v.kids {
+		got := contents(t, k)
+		found := false
+		for _, d := range data {
+			found = found || bytes.Equal(got, d)
+		}
+		if !found {
+			t.Fatalf("%s: %d bytes, not a version written", k.Name, len(got))
+		}
+	}
+	for _, sig := range peer.requests() {
+		delete(moved, sig)
+	}
+	if len(moved) != 0 {
+		t.Fatalf("%d of the moved blocks never fetched", len(moved))
+	}
+}
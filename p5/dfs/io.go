@@ -5,13 +5,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"github.com/syndtr/goleveldb/leveldb"
-	"os"
 	"time"
 )
 
-var db *leveldb.DB
+var db BlockStore
 
+// defaults, see ChunkParams
 const (
 	HASHLEN     = 32
 	THE_PRIME   = 31
@@ -20,52 +19,24 @@ const (
 	MAXCHUNK    = 8192
 )
 
-var b uint64 = 0
-var saved [256]uint64
-
 //=============================================================================
 func initStore(newfs bool, dbPath string) {
 	var err error
 
-	if newfs {
-		os.RemoveAll(dbPath)
-	}
-	db, err = leveldb.OpenFile(dbPath, nil)
+	db, err = openStore(newfs, dbPath)
 
 	if err != nil {
 		p_die("no open db: %s\n", err)
 	}
-}
-
-// returns len of next chunk
-func rkChunk(buf []byte) int {
-	var off uint64
-	var hash uint64
-	var b_n uint64
-	if b == 0 {
-		b = THE_PRIME
-		b_n = 1
-		for i := 0; i < (HASHLEN - 1); i++ {
-			b_n *= b
-		}
-		for i := uint64(0); i < 256; i++ {
-			saved[i] = i * b_n
-		}
-	}
 
-	for off = 0; off < HASHLEN && off < uint64(len(buf)); off++ {
-		hash = hash*b + uint64((buf[off]))
+	var opts map[string]string
+	if Merep != nil {
+		opts = Merep.Opts
 	}
-
-	for off < uint64(len(buf)) {
-		hash = (hash-saved[buf[off-HASHLEN]])*b + uint64(buf[off])
-		off++
-
-		if (off >= MINCHUNK && ((hash % TARGETCHUNK) == 1)) || (off >= MAXCHUNK) {
-			return int(off)
-		}
+	if cfg := s3Config(opts); cfg != nil {
+		p_err("write-back to s3 %s/%s\n", cfg.Endpoint, cfg.Bucket)
+		db = newCachedStore(db, NewS3Store(*cfg))
 	}
-	return int(off)
 }
 
 // return base64 (stringified) version of sha1 hash of array of bytes
@@ -74,25 +45,107 @@ func shaString(buf []byte) string {
 	return base64.StdEncoding.EncodeToString(h[:])
 }
 
-// Use rk fingerprints to chunkify array of data. Take the
+// Use the chunker to chunkify array of data. Take the
 // stringified sha1 hash of each such chunk and use as key
-// to store in key-value store. Return array of such strings.
-func putBlocks(data []byte) (s []string) {
+// to store in key-value store. Return array of such strings,
+// and the length of each chunk; long runs of zeros are holes ("").
+func putBlocks(data []byte) (s []string, lens []uint64) {
 	off := 0
 	for off < len(data) {
-		ret := rkChunk(data[off:])
+		hole, ret := nextExtent(data[off:])
 		// p_out("offset: %d, length: %d\n", off, ret)
-		s = append(s, putBlock(data[off:(off+ret)]))
+		sig := ""
+		if !hole {
+			sig = putBlock(data[off:(off + ret)])
+		}
+		s, lens = addExtent(s, lens, sig, uint64(ret))
 		off += ret
 	}
 	return
 }
 
-// puts a block of data at key defined by hash of data. Return ASCII hash.
+// Chunk the windows, reusing the old extents outside what changed in
+// each. Chunk boundaries depend only on the bytes since the previous
+// boundary, so we restart at the boundary before the window's changes
+// (redoing the chunk that ends there, which may have been cut short by
+// the old end of file) and stop as soon as a new boundary past them lands
+// on an old one; from there on the old chunks are unchanged. Windows
+// start and end on old boundaries, but the last chunk of one may run on
+// past it, so we read on into the extents after it until it ends; the
+// chunks are then those chunking the whole file would give, but for
+// boundaries left at the edges of holes.
+func (n *DNode) rechunk() (sigs []string, lens []uint64) {
+	olens := n.blockLens()
+	offs := n.extentStarts()
+	j := 0 // next old extent
+	for _, w := range n.wins {
+		for ; j < len(olens) && offs[j] < w.off; j++ {
+			sigs, lens = addExtent(sigs, lens, n.DataBlocks[j], olens[j])
+		}
+		k := j // old extents in the window are [j, k)
+		for k < len(olens) && offs[k] < w.end() {
+			k++
+		}
+		if w.lo >= w.hi {
+			continue // nothing changed; its extents are copied as they are
+		}
+		for ; j < k && offs[j+1] < w.lo; j++ {
+			sigs, lens = addExtent(sigs, lens, n.DataBlocks[j], olens[j])
+		}
+
+		data, base, end := w.data, w.off, offs[k]
+		off, i := offs[j], j
+		for off < end {
+			hole, ret := nextExtent(data[off-base : end-base])
+			if off+uint64(ret) == end && k < len(olens) && n.DataBlocks[k] != "" {
+				if more, err := n.readRange(offs[k], offs[k+1]); err == nil {
+					data = append(data[:end-base:end-base], more...)
+					k++
+					end = offs[k]
+					continue
+				}
+			}
+			sig := ""
+			if !hole {
+				sig = putBlock(data[off-base : off-base+uint64(ret)])
+			}
+			sigs, lens = addExtent(sigs, lens, sig, uint64(ret))
+			off += uint64(ret)
+
+			for i < k && offs[i] < off {
+				i++
+			}
+			if off >= w.hi && i < k && offs[i] == off {
+				p_out("rechunk %q: resync at %d\n", n.Name, off)
+				break
+			}
+		}
+		j = i
+		if off >= end {
+			j = k
+		}
+	}
+	for ; j < len(olens); j++ {
+		sigs, lens = addExtent(sigs, lens, n.DataBlocks[j], olens[j])
+	}
+
+	// the extents add up to Size already; merged holes are fine
+	return
+}
+
+// true for keys that are block signatures, rather than "head" etc.
+func isSig(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == sha1.Size
+}
+
+// puts a block of data at key defined by hash of data, compressed if
+// Compress is set. Return ASCII hash.
 func putBlock(data []byte) string {
 	sig := shaString(data)
-	if err := putBlockSig(sig, data); err == nil {
-		db.Put([]byte(sig), data, nil)
+	enc := encodeBlock(data)
+	if err := putBlockSig(sig, enc); err == nil {
+		stats.add(len(data), len(enc))
 		return sig
 	} else {
 		panic(fmt.Sprintf("FAIL: putBlock(%s): [%q]\n", sig, err))
@@ -101,13 +154,13 @@ func putBlock(data []byte) string {
 
 // store data at a specific key, used for "head"
 func putBlockSig(s string, data []byte) error {
-	return db.Put([]byte(s), data, nil)
+	return db.Put(s, data)
 }
 
 // []byte or nil
 func getBlock(key string) []byte {
-	if val, err := db.Get([]byte(key), nil); err == nil {
-		return val
+	if val, err := db.Get(key); err == nil {
+		return decodeBlock(key, val)
 	}
 	return nil
 }
@@ -122,33 +175,36 @@ func Marshal(toMarshal interface{}) []byte {
 
 func getDNode(sig string) *DNode {
 	n := new(DNode)
-	if val, err := db.Get([]byte(sig), nil); err == nil {
+	if val := getBlock(sig); val != nil {
 		json.Unmarshal(val, &n)
 		n.kids = make(map[string]*DNode)
 		return n
 	} else {
-		p_out("ERROR: getDNode [%s]\n", err)
+		p_out("ERROR: getDNode [%s]\n", sig)
 		return nil
 	}
 }
 
-func getRemoteDNode(owner int, name string) *DNode {
-	if owner != Merep.Pid {
-		p_out("Requesting DNODE: %s\n", name)
-		var enc_reply []byte
-		req := prepare_request(name, Merep.Pid)
-		Clients[owner].Call("Node.ReqDNode", req, &enc_reply)
-		reply := accept_response(enc_reply)
-		if reply.DN != nil {
-			reply.DN.kids = make(map[string]*DNode)
-			return reply.DN
-		}
+// local copy if we have one, otherwise ask the owner (or anyone else)
+func fetchDNode(owner int, sig string) *DNode {
+	if n := getDNode(sig); n != nil {
+		return n
+	}
+	return getRemoteDNode(owner, sig)
+}
 
+// Kept as the block it was stored as, which ReqDNode sends along so its
+// hash can be checked.
+func getRemoteDNode(owner int, sig string) *DNode {
+	p_out("Requesting DNODE: %s\n", sig)
+	if fetchRemote("Node.ReqDNode", owner, sig) == nil {
+		p_out("ERROR: getRemoteDNode\n")
+		return nil
 	}
-	p_out("ERROR: getRemoteDNode\n")
-	return nil
+	return getDNode(sig)
 }
 
+// Marks n and everything up to the root. Caller holds meta.
 func markDirty(n *DNode) {
 	var nd = n
 	for {
@@ -170,3 +226,52 @@ func markDirty(n *DNode) {
 	n.Attrs.Atime = time.Now()
 	n.metaDirty = true
 }
+
+// Caller holds meta.
+func inArchive(n *DNode) bool {
+	for ; n != nil; n = n.parent {
+		if n.archive {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses an absolute time, in one of the formats below.
+func peteTime(s string) (time.Time, bool) {
+	timeFormats := []string{"2006-1-2 15:04:05", "2006-1-2 15:04", "2006-1-2",
+		"1-2-2006 15:04:05", "1-2-2006 15:04", "1-6-2006", "2006/1/2 15:04:05",
+		"2006/1/2 15:04", "2006/1/2", "1/2/2006 15:04:05", "1/2/2006 15:04", "1/2/2006"}
+	loc, _ := time.LoadLocation("Local")
+
+	for _, v := range timeFormats {
+		if tm, terr := time.ParseInLocation(v, s, loc); terr == nil {
+			return tm, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// The version of top that was current at tm, following PrevSig (from
+// the owner if it's not stored here). nil if the chain is cut before
+// then, by gc freeing versions only pruned roots had.
+func (top *DNode) timeTravel(tm time.Time) *DNode {
+	if tm.After(top.Attrs.Atime) {
+		return top
+	}
+	var preTop *DNode
+	for top.PrevSig != "" {
+		if preTop = fetchDNode(top.Owner, top.PrevSig); preTop == nil {
+			p_out("timeTravel: %q before %s is gone\n", top.Name, top.Attrs.Atime)
+			return nil
+		}
+		preTop.sig = top.PrevSig
+		p_out("preTop: %s, top: %s\n", preTop.Attrs.Atime, top.Attrs.Atime)
+		if tm.After(preTop.Attrs.Atime) &&
+			tm.Before(top.Attrs.Atime) {
+			return preTop
+		}
+		top = preTop
+	}
+	return top
+}
@@ -0,0 +1,94 @@
+package dfs
+
+import (
+	"strconv"
+	"strings"
+)
+
+//=============================================================================
+// Hard links.
+//
+// A directory entry is normally the sig of the child, so a file with two
+// entries would need every directory holding it rewritten whenever it
+// changes. Instead, once a file gets a second link all of its entries
+// become INOREF+inode, and the root's Inodes table maps the inode to the
+// file's current sig. Each root version carries its own table, so history,
+// snapshots, gc and replication see the links as they were.
+//
+// In memory every entry shares one DNode (the one in nodeMap), so Nlink
+// and the data are always the same through any name. The entry stays an
+// INOREF when Nlink drops back to 1; the table entry goes when it hits 0.
+
+const INOREF = "ino:"
+
+func inoRef(ino uint64) string {
+	return INOREF + strconv.FormatUint(ino, 10)
+}
+
+func isInoRef(ref string) bool {
+	return strings.HasPrefix(ref, INOREF)
+}
+
+func refIno(ref string) uint64 {
+	ino, _ := strconv.ParseUint(ref[len(INOREF):], 10, 64)
+	return ino
+}
+
+// The table INOREF entries under n resolve through: that of the root n
+// hangs off, which for history is the root version it came from.
+// name@versions views of directories fall back to the current table.
+func (n *DNode) inodeTable() map[uint64]string {
+	for d := n; d != nil; d = d.parent {
+		if d.Inodes != nil {
+			return d.Inodes
+		}
+	}
+	return root.Inodes
+}
+
+// The sig of child name, resolving hard links. Caller holds meta.
+func (n *DNode) childSig(name string) (string, bool) {
+	ref, ok := n.ChildSigs[name]
+	if !ok || !isInoRef(ref) {
+		return ref, ok
+	}
+	sig, ok := n.inodeTable()[refIno(ref)]
+	return sig, ok
+}
+
+// Whether the entry name refers to c through the inode table.
+func (n *DNode) isLink(name string, c *DNode) bool {
+	return !c.Attrs.Mode.IsDir() && (c.Attrs.Nlink > 1 || isInoRef(n.ChildSigs[name]))
+}
+
+// Drops entry name from n, and the file's data with its last link.
+// Called with n's inode lock held.
+func (n *DNode) unlink(name string) bool {
+	c := n.loadChild(name)
+	meta.Lock()
+	_, inSigs := n.ChildSigs[name]
+	if c == nil && !inSigs {
+		meta.Unlock()
+		return false
+	}
+	delete(n.kids, name)
+	delete(n.ChildSigs, name)
+	markDirty(n)
+	if c == nil {
+		meta.Unlock()
+		return true
+	}
+	if n.isLink(name, c) && c.Attrs.Nlink > 1 {
+		c.Attrs.Nlink--
+		markDirty(c)
+		root.metaDirty = true // flush it through the table, even if c's parent is gone
+		meta.Unlock()
+		return true
+	}
+	delete(root.Inodes, c.Attrs.Inode)
+	if _, ok := nodeMap[c.Attrs.Inode]; ok {
+		nodeMap[c.Attrs.Inode] = nil
+	}
+	meta.Unlock()
+	return true
+}
@@ -0,0 +1,77 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+func TestHardLinks(t *testing.T) {
+	f := newSparseFile(t)
+	ctx := context.Background()
+	f.write(0, noise(1, 20000))
+	f.flush()
+	d, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "d", Mode: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []*DNode{root, d.(*DNode)} {
+		if _, err := dir.Link(ctx, &fuse.LinkRequest{NewName: "g"}, f.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ino := f.n.Attrs.Inode
+	flushRoot()
+	restart()
+
+	// every name is the one file, across a restart
+	g := lookup(t, root, "g")
+	if g != lookup(t, root, "f") || g != lookup(t, lookup(t, root, "d"), "g") || g.Attrs.Nlink != 3 {
+		t.Fatalf("names not one file, Nlink %d", g.Attrs.Nlink)
+	}
+	if got := contents(t, g); !bytes.Equal(got, f.want) {
+		t.Fatal("read through the link", len(got))
+	}
+
+	// the data is only reachable through root.Inodes; gc keeps it
+	for _, name := range []string{"f", "g"} {
+		if !isInoRef(root.ChildSigs[name]) {
+			t.Fatalf("%s is %q", name, root.ChildSigs[name])
+		}
+	}
+	for _, history := range []bool{true, false} {
+		if _, err := gc(history, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, sig := range append([]string{root.Inodes[ino]}, g.DataBlocks...) {
+			if !db.Has(sig) {
+				t.Fatalf("gc (history %v) freed %s", history, sig)
+			}
+		}
+	}
+	restart()
+	if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, f.want) {
+		t.Fatal("read after gc", len(got))
+	}
+
+	// the last name takes the table entry with it
+	for i, name := range []string{"f", "d/g", "g"} {
+		dir := root // a new one after each restart
+		if i == 1 {
+			dir, name = lookup(t, root, "d"), "g"
+		}
+		if err := dir.Remove(ctx, &fuse.RemoveRequest{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		flushRoot()
+		restart()
+		if _, ok := root.Inodes[ino]; ok != (i < 2) {
+			t.Fatalf("after unlinking %d names, table entry %v", i+1, ok)
+		}
+		if i < 2 && lookup(t, root, "g").Attrs.Nlink != uint32(2-i) {
+			t.Fatalf("after unlinking %d names, Nlink %d", i+1, lookup(t, root, "g").Attrs.Nlink)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//=============================================================================
+// Cluster membership. config.txt says where replicas are; which of them
+// are in the cluster is decided at runtime. A new replica joins through
+// the member it authenticates with (-a): that member adds it, tells the
+// others, and hands back the full list. "leave" gets a replica's updates
+// out, then tells every member to drop it.
+//
+// Each replica keeps the list in its store, under "members", so the
+// cluster's shape survives restarts; -r only seeds it on the first run.
+// A member that's down misses the news, and keeps its old list.
+
+// Guards Replicas and Clients, which are replaced on a change rather
+// than modified, so whoever's ranging over the old ones can carry on.
+var membersMu sync.Mutex
+
+// Set once we've joined through someone this run; what they said beats
+// what's stored.
+var joined bool
+
+type memberMsg struct {
+	Joining  *Replica `json:",omitempty"`
+	Leaving  int      `json:",omitempty"`
+	Announce bool     // passed on by a member; don't pass it on again
+}
+
+func clients() map[int]*serverConn {
+	membersMu.Lock()
+	c := Clients
+	membersMu.Unlock()
+	return c
+}
+
+func replica(pid int) *Replica {
+	membersMu.Lock()
+	r := Replicas[pid]
+	membersMu.Unlock()
+	return r
+}
+
+// Every member, us included, by pid.
+func memberList() []*Replica {
+	membersMu.Lock()
+	var l []*Replica
+	for _, r := range Replicas {
+		l = append(l, r)
+	}
+	membersMu.Unlock()
+	sort.Slice(l, func(i, j int) bool { return l[i].Pid < l[j].Pid })
+	return l
+}
+
+// Makes l (plus us) the members, keeping connections to those that stay,
+// and stores the list.
+func setMembers(l []*Replica) {
+	reps := map[int]*Replica{Merep.Pid: Merep}
+	conns := make(map[int]*serverConn)
+	membersMu.Lock()
+	for _, r := range l {
+		if r.Pid == Merep.Pid {
+			continue
+		}
+		reps[r.Pid] = r
+		if c := Clients[r.Pid]; c != nil && c.Addr == fmt.Sprintf("%s:%d", r.Addr, r.Port) {
+			conns[r.Pid] = c
+		} else {
+			conns[r.Pid] = NewServerConn(r.Addr, r.Port)
+		}
+	}
+	Replicas, Clients = reps, conns
+	membersMu.Unlock()
+
+	repl.Lock()
+	for pid := range repl.peers {
+		if conns[pid] == nil {
+			delete(repl.peers, pid)
+		}
+	}
+	repl.Unlock()
+	saveMembers()
+}
+
+func saveMembers() {
+	if db == nil {
+		return // not open yet; Init stores it
+	}
+	if err := putBlockSig("members", Marshal(memberList())); err != nil {
+		p_err("storing members: %v\n", err)
+	}
+}
+
+// The list stored by an earlier run, if any, replaces the one from -r.
+func loadMembers() {
+	val, err := db.Get("members")
+	if joined || err != nil {
+		saveMembers()
+		return
+	}
+	var l []*Replica
+	if err := json.Unmarshal(val, &l); err != nil {
+		p_err("stored members: %v, using -r\n", err)
+		saveMembers()
+		return
+	}
+	setMembers(l)
+}
+
+// Sends m to every member but us and skip, in the background.
+func tellMembers(method string, m memberMsg, skip int) {
+	for pid, c := range clients() {
+		if pid == skip {
+			continue
+		}
+		go func(pid int, c *serverConn) {
+			var reply []byte
+			req := aesEncrypt(AESkey, Marshal(m))
+			if err := c.Call(method, &req, &reply); err != nil {
+				p_err("%s to %d: %v\n", method, pid, err)
+			}
+		}(pid, c)
+	}
+}
+
+// Joins the cluster through member pid, once we've its session key.
+func Join(pid int) error {
+	c := clients()[pid]
+	if c == nil {
+		return fmt.Errorf("join: %d isn't a replica", pid)
+	}
+	var reply []byte
+	req := aesEncrypt(AESkey, Marshal(memberMsg{Joining: Merep}))
+	if err := c.Call("Node.Join", &req, &reply); err != nil {
+		return fmt.Errorf("join through %d: %v", pid, err)
+	}
+	var l []*Replica
+	if err := json.Unmarshal(AESDecrypt(AESkey, reply), &l); err != nil || len(l) == 0 {
+		return fmt.Errorf("join through %d: refused", pid)
+	}
+	setMembers(l)
+	joined = true
+	p_err("joined through %d, %d members\n", pid, len(l))
+	return nil
+}
+
+// Adds the replica joining, and answers with every member.
+func (nd *Node) Join(encrypted *[]byte, rep *[]byte) error {
+	var m memberMsg
+	json.Unmarshal(AESDecrypt(AESkey, *encrypted), &m)
+	r := m.Joining
+	if r == nil {
+		*rep = aesEncrypt(AESkey, Marshal([]*Replica(nil)))
+		return nil
+	}
+	if old := replica(r.Pid); old != nil && old.Name != r.Name {
+		p_err("%q can't join as %d, that's %q\n", r.Name, r.Pid, old.Name)
+		*rep = aesEncrypt(AESkey, Marshal([]*Replica(nil)))
+		return nil
+	}
+	l := []*Replica{r}
+	for _, o := range memberList() {
+		if o.Pid != r.Pid {
+			l = append(l, o)
+		}
+	}
+	setMembers(l)
+	p_err("%q (%d) joined, %d members\n", r.Name, r.Pid, len(l))
+	if !m.Announce {
+		m.Announce = true
+		tellMembers("Node.Join", m, r.Pid)
+	}
+	*rep = aesEncrypt(AESkey, Marshal(memberList()))
+	return nil
+}
+
+// Drops the replica leaving.
+func (nd *Node) Leave(encrypted *[]byte, rep *[]byte) error {
+	var m memberMsg
+	json.Unmarshal(AESDecrypt(AESkey, *encrypted), &m)
+	if r := replica(m.Leaving); r != nil && r != Merep {
+		var l []*Replica
+		for _, o := range memberList() {
+			if o.Pid != m.Leaving {
+				l = append(l, o)
+			}
+		}
+		setMembers(l)
+		p_err("%q (%d) left, %d members\n", r.Name, r.Pid, len(l))
+	}
+	*rep = prepare_response(true, Merep.Pid, nil, nil)
+	return nil
+}
+
+// "leave": flushes, and once another member has everything, has them
+// all drop us. Runs without the tree lock, as it waits on the others.
+func cmdLeave(args []string) (string, error) {
+	peers := clients()
+	if len(peers) == 0 {
+		return "", fmt.Errorf("leave: no other members (is the replica mounted?)")
+	}
+	tree.RLock()
+	flushRoot()
+	tree.RUnlock()
+	last, _ := sendOutbox()
+	has := false
+	repl.Lock()
+	for pid := range peers {
+		q := peerQ(pid)
+		has = has || !q.resync && q.acked >= last
+	}
+	repl.Unlock()
+	if !has {
+		return "", fmt.Errorf("leave: no member has all our updates yet (see \"repl\"), try again")
+	}
+
+	var buf bytes.Buffer
+	req := aesEncrypt(AESkey, Marshal(memberMsg{Leaving: Merep.Pid}))
+	var pids []int // those we had, whoever's joined or left since
+	for pid := range peers {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		var reply []byte
+		name := replicaName(pid)
+		if err := peers[pid].Call("Node.Leave", &req, &reply); err != nil {
+			fmt.Fprintf(&buf, "%s: %v, still lists us\n", name, err)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: dropped us\n", name)
+	}
+	setMembers(nil)
+	fmt.Fprintf(&buf, "left the cluster\n")
+	return buf.String(), nil
+}
+
+// "members": the stored list, which is the live one if we're mounted.
+func cmdMembers(args []string) (string, error) {
+	l := memberList()
+	if val, err := db.Get("members"); err == nil {
+		json.Unmarshal(val, &l)
+	}
+	var buf bytes.Buffer
+	for _, r := range l {
+		me := ""
+		if Merep != nil && r.Pid == Merep.Pid {
+			me = " (us)"
+		}
+		fmt.Fprintf(&buf, "%3d %-10s %s:%d%s\n", r.Pid, r.Name, r.Addr, r.Port, me)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,47 @@
+package dfs
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+type memberPeer struct {
+	ackPeer
+	left bool
+}
+
+func (p *memberPeer) Leave(encrypted *[]byte, rep *[]byte) error {
+	p.left = true
+	*rep = prepare_response(true, 2, nil, nil)
+	return nil
+}
+
+// A member that's already gone from Replicas when "leave" gets to it
+// is still told, by pid.
+func TestLeaveMembershipChanging(t *testing.T) {
+	testFS(t)
+	AESkey = make([]byte, 16)
+	repl.seq, repl.committed, repl.peers = 0, 0, nil
+	peer := &memberPeer{}
+	srv := rpc.NewServer()
+	srv.RegisterName("Node", peer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(l)
+
+	Replicas = map[int]*Replica{1: Merep} // 2 left meanwhile
+	Clients = map[int]*serverConn{2: NewServerConn("127.0.0.1", l.Addr().(*net.TCPAddr).Port)}
+	defer func() { Replicas, Clients = nil, map[int]*serverConn{} }()
+	out, err := cmdLeave(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peer.left || !strings.Contains(out, "replica2: dropped us") {
+		t.Fatalf("leave said:\n%s", out)
+	}
+}
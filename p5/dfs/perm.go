@@ -0,0 +1,376 @@
+package dfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+)
+
+//=============================================================================
+// Permission checks, against the uid/gid of the process making each
+// request. Owner/group/other bits, the sticky bit, uid 0 overriding
+// everything but exec, and POSIX ACLs if the node has one (setfacl stores
+// them through the xattr calls, as ACL_XATTR).
+//
+// Reads and writes are checked when the file is opened, not per call,
+// as in the kernel.
+
+const (
+	P_READ  = 4
+	P_WRITE = 2
+	P_EXEC  = 1
+)
+
+const (
+	ACL_XATTR         = "system.posix_acl_access"
+	ACL_DEFAULT_XATTR = "system.posix_acl_default"
+)
+
+// ACL entry tags, and the on-the-wire xattr format, as in linux/posix_acl_xattr.h
+const (
+	ACL_USER_OBJ  = 0x01
+	ACL_USER      = 0x02
+	ACL_GROUP_OBJ = 0x04
+	ACL_GROUP     = 0x08
+	ACL_MASK      = 0x10
+	ACL_OTHER     = 0x20
+
+	aclVersion = 2
+)
+
+type aclEntry struct {
+	Tag  uint16
+	Perm uint16
+	Id   uint32
+}
+
+func parseACL(b []byte) ([]aclEntry, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 || binary.LittleEndian.Uint32(b) != aclVersion {
+		return nil, fmt.Errorf("bad acl")
+	}
+	var acl []aclEntry
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		acl = append(acl, aclEntry{
+			Tag:  binary.LittleEndian.Uint16(b),
+			Perm: binary.LittleEndian.Uint16(b[2:]),
+			Id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return acl, nil
+}
+
+func encodeACL(acl []aclEntry) []byte {
+	b := make([]byte, 4+8*len(acl))
+	binary.LittleEndian.PutUint32(b, aclVersion)
+	for i, e := range acl {
+		binary.LittleEndian.PutUint16(b[4+8*i:], e.Tag)
+		binary.LittleEndian.PutUint16(b[6+8*i:], e.Perm)
+		binary.LittleEndian.PutUint32(b[8+8*i:], e.Id)
+	}
+	return b
+}
+
+// Groups read from /proc, by pid. A request checks several nodes (each
+// step of a path, both directories of a rename), so they're kept for a
+// moment rather than read for each.
+var groupCache = struct {
+	sync.Mutex
+	m map[uint32]cachedGroups
+}{m: make(map[uint32]cachedGroups)}
+
+type cachedGroups struct {
+	gid    uint32
+	groups []uint32
+	at     time.Time
+}
+
+const GROUPCACHE = time.Second
+
+// Who's making a request, and its groups. The groups may come from
+// /proc, so they're looked up before meta is taken (see fs.go), and
+// handed to the checks below.
+type caller struct {
+	fuse.Header
+	groups []uint32
+}
+
+func callerOf(h fuse.Header) caller {
+	c := caller{Header: h}
+	if h.Uid != 0 { // root doesn't need them
+		c.groups = callerGroups(h)
+	}
+	return c
+}
+
+// The caller's groups: its gid, plus the supplementary groups of the
+// requesting process if /proc has them.
+func callerGroups(h fuse.Header) []uint32 {
+	now := time.Now()
+	groupCache.Lock()
+	c, ok := groupCache.m[h.Pid]
+	groupCache.Unlock()
+	if ok && c.gid == h.Gid && now.Sub(c.at) < GROUPCACHE {
+		return c.groups
+	}
+	groups := procGroups(h)
+	groupCache.Lock()
+	if len(groupCache.m) > 1000 {
+		groupCache.m = make(map[uint32]cachedGroups)
+	}
+	groupCache.m[h.Pid] = cachedGroups{h.Gid, groups, now}
+	groupCache.Unlock()
+	return groups
+}
+
+func procGroups(h fuse.Header) []uint32 {
+	groups := []uint32{h.Gid}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", h.Pid))
+	if err != nil {
+		return groups
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := s.Text(); strings.HasPrefix(line, "Groups:") {
+			for _, g := range strings.Fields(line[len("Groups:"):]) {
+				if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+					groups = append(groups, uint32(id))
+				}
+			}
+			break
+		}
+	}
+	return groups
+}
+
+func inGroup(c caller, gid uint32) bool {
+	for _, g := range c.groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the caller may access n for want (a mix of P_READ, P_WRITE and
+// P_EXEC).
+func access(n *DNode, h caller, want uint32) bool {
+	mode := uint32(n.Attrs.Mode.Perm())
+	if h.Uid == 0 {
+		// root needs an x bit somewhere to exec a file
+		return want&P_EXEC == 0 || n.Attrs.Mode.IsDir() || mode&0111 != 0
+	}
+	if acl, err := parseACL(n.Xattrs[ACL_XATTR]); err == nil {
+		return aclAccess(n, acl, h, want)
+	}
+	switch {
+	case h.Uid == n.Attrs.Uid:
+		mode >>= 6
+	case inGroup(h, n.Attrs.Gid):
+		mode >>= 3
+	}
+	return mode&want == want
+}
+
+// POSIX.1e: the owner entry, else a named user entry, else any matching
+// group entry that grants want, else other. Named users and groups are
+// limited by the mask.
+func aclAccess(n *DNode, acl []aclEntry, h caller, want uint32) bool {
+	mask := uint16(7)
+	for _, e := range acl {
+		if e.Tag == ACL_MASK {
+			mask = e.Perm
+		}
+	}
+	if h.Uid == n.Attrs.Uid {
+		for _, e := range acl {
+			if e.Tag == ACL_USER_OBJ {
+				return uint32(e.Perm)&want == want
+			}
+		}
+	}
+	for _, e := range acl {
+		if e.Tag == ACL_USER && e.Id == h.Uid {
+			return uint32(e.Perm&mask)&want == want
+		}
+	}
+	matched := false
+	for _, e := range acl {
+		var gid uint32
+		switch e.Tag {
+		case ACL_GROUP_OBJ:
+			gid = n.Attrs.Gid
+		case ACL_GROUP:
+			gid = e.Id
+		default:
+			continue
+		}
+		for _, g := range h.groups {
+			if g == gid {
+				matched = true
+				if uint32(e.Perm&mask)&want == want {
+					return true
+				}
+			}
+		}
+	}
+	if matched {
+		return false
+	}
+	for _, e := range acl {
+		if e.Tag == ACL_OTHER {
+			return uint32(e.Perm)&want == want
+		}
+	}
+	return false
+}
+
+// access(2), so "test -w" and the like get the answer the other calls
+// would. The mask bits are P_READ, P_WRITE and P_EXEC; 0 is F_OK.
+func (n *DNode) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	who := callerOf(req.Header)
+	enter(n)
+	meta.Lock()
+	want := req.Mask & (P_READ | P_WRITE | P_EXEC)
+	if want&P_WRITE != 0 && inArchive(n) {
+		meta.Unlock()
+		leave()
+		return fuse.EPERM
+	}
+	ok := access(n, who, want)
+	meta.Unlock()
+	leave()
+	if !ok {
+		return EACCES
+	}
+	return nil
+}
+
+func isOwner(n *DNode, h fuse.Header) bool {
+	return h.Uid == 0 || h.Uid == n.Attrs.Uid
+}
+
+// Whether the caller may create or remove entries in dir n.
+func canModifyDir(n *DNode, h caller) bool {
+	return access(n, h, P_WRITE|P_EXEC)
+}
+
+// With the sticky bit on dir, only the owner of child or of dir (or
+// root) may remove or rename it.
+func stickyOK(dir, child *DNode, h caller) bool {
+	return dir.Attrs.Mode&os.ModeSticky == 0 || child == nil ||
+		isOwner(dir, h.Header) || isOwner(child, h.Header)
+}
+
+// Keeps an access ACL and the mode's permission bits in step, as chmod
+// and setfacl both change the pair: the owner, group (the mask, if
+// there is one) and other entries are the mode bits.
+func (n *DNode) syncACL(fromMode bool) {
+	acl, err := parseACL(n.Xattrs[ACL_XATTR])
+	if err != nil {
+		return
+	}
+	hasMask := false
+	for _, e := range acl {
+		hasMask = hasMask || e.Tag == ACL_MASK
+	}
+	mode := uint16(n.Attrs.Mode.Perm())
+	for i, e := range acl {
+		shift := uint(0)
+		switch {
+		case e.Tag == ACL_USER_OBJ:
+			shift = 6
+		case e.Tag == ACL_MASK || (e.Tag == ACL_GROUP_OBJ && !hasMask):
+			shift = 3
+		case e.Tag == ACL_OTHER:
+		default:
+			continue
+		}
+		if fromMode {
+			acl[i].Perm = (mode >> shift) & 7
+		} else {
+			mode = mode&^(7<<shift) | (e.Perm&7)<<shift
+		}
+	}
+	if fromMode {
+		n.Xattrs[ACL_XATTR] = encodeACL(acl)
+	} else {
+		n.Attrs.Mode = n.Attrs.Mode&^os.ModePerm | os.FileMode(mode)
+	}
+}
+
+// A new node in dir gets dir's default ACL, if it has one, limited by
+// the mode it was created with; directories inherit the default too.
+func (n *DNode) inheritACL(dir *DNode) {
+	def, ok := dir.Xattrs[ACL_DEFAULT_XATTR]
+	if !ok {
+		return
+	}
+	if _, err := parseACL(def); err != nil {
+		return
+	}
+	n.Xattrs = map[string][]byte{ACL_XATTR: append([]byte(nil), def...)}
+	if n.Attrs.Mode.IsDir() {
+		n.Xattrs[ACL_DEFAULT_XATTR] = append([]byte(nil), def...)
+	}
+	created := n.Attrs.Mode.Perm()
+	n.syncACL(false)
+	n.Attrs.Mode &^= os.ModePerm &^ created
+	n.syncACL(true)
+}
+
+// Who may touch which xattrs: trusted.* and security.* are root's, ACLs
+// the owner's, the rest (user.*) follow the file's own permissions.
+func xattrAccess(n *DNode, h caller, name string, write bool) bool {
+	switch {
+	case strings.HasPrefix(name, "trusted."):
+		return h.Uid == 0
+	case strings.HasPrefix(name, "security."):
+		return !write || h.Uid == 0
+	case strings.HasPrefix(name, "system.posix_acl_"):
+		return !write || isOwner(n, h.Header)
+	case write:
+		return access(n, h, P_WRITE)
+	}
+	return access(n, h, P_READ)
+}
+
+var EACCES = fuse.Errno(syscall.EACCES)
+
+// chmod, chown and utimes are the owner's (or root's); truncate needs
+// write access unless it's through an open file.
+func (n *DNode) setattrCheck(req *fuse.SetattrRequest, h caller) error {
+	if req.Valid.Mode() && !isOwner(n, h.Header) {
+		return fuse.EPERM
+	}
+	if req.Valid.Uid() && h.Uid != 0 && req.Uid != n.Attrs.Uid {
+		return fuse.EPERM
+	}
+	if req.Valid.Gid() && h.Uid != 0 && req.Gid != n.Attrs.Gid &&
+		(h.Uid != n.Attrs.Uid || !inGroup(h, req.Gid)) {
+		return fuse.EPERM
+	}
+	if req.Valid.Size() && !req.Valid.Handle() && !access(n, h, P_WRITE) {
+		return EACCES
+	}
+	if (req.Valid.Atime() || req.Valid.Mtime()) && !isOwner(n, h.Header) {
+		// anyone who can write may set both to now ("touch")
+		if !(req.Valid.AtimeNow() || req.Valid.MtimeNow()) {
+			return fuse.EPERM
+		}
+		if !access(n, h, P_WRITE) {
+			return EACCES
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package dfs
+
+import (
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+func TestAccess(t *testing.T) {
+	f := newSparseFile(t)
+	f.write(0, noise(1, 100))
+	f.flush()
+	flushRoot()
+	f.n.Attrs.Uid, f.n.Attrs.Gid, f.n.Attrs.Mode = 1000, 1000, 0640
+	ctx := context.Background()
+	tests := []struct {
+		uid, gid uint32
+		mask     uint32
+		err      error
+	}{
+		{1000, 1000, P_READ | P_WRITE, nil},
+		{1000, 1000, P_EXEC, EACCES},
+		{2000, 1000, P_READ, nil},
+		{2000, 1000, P_WRITE, EACCES},
+		{2000, 2000, P_READ, EACCES},
+		{2000, 2000, 0, nil}, // F_OK
+		{0, 0, P_READ | P_WRITE, nil},
+		{0, 0, P_EXEC, EACCES},
+	}
+	for _, tc := range tests {
+		// pid 0 has no /proc entry, so no supplementary groups
+		h := fuse.Header{Uid: tc.uid, Gid: tc.gid}
+		if err := f.n.Access(ctx, &fuse.AccessRequest{Header: h, Mask: tc.mask}); err != tc.err {
+			t.Errorf("uid %d gid %d mask %o: %v, want %v", tc.uid, tc.gid, tc.mask, err, tc.err)
+		}
+	}
+
+	// supplementary groups, as if just read from /proc
+	groupCache.Lock()
+	groupCache.m[4242] = cachedGroups{3000, []uint32{3000, 1000}, time.Now()}
+	groupCache.Unlock()
+	h := fuse.Header{Uid: 2000, Gid: 3000, Pid: 4242}
+	if err := f.n.Access(ctx, &fuse.AccessRequest{Header: h, Mask: P_READ}); err != nil {
+		t.Error("reading as a member of the file's group:", err)
+	}
+	h.Pid = 4243
+	if err := f.n.Access(ctx, &fuse.AccessRequest{Header: h, Mask: P_READ}); err != EACCES {
+		t.Error("reading as a non-member:", err)
+	}
+
+	v, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "f@-0s"}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := v.(*DNode)
+	if err := old.Access(ctx, &fuse.AccessRequest{Mask: P_READ}); err != nil {
+		t.Error("reading history:", err)
+	}
+	if err := old.Access(ctx, &fuse.AccessRequest{Mask: P_WRITE}); err != fuse.EPERM {
+		t.Error("writing history:", err)
+	}
+}
@@ -0,0 +1,216 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Serves blocks from a map, and notes what was asked for. A block in
+// hold is only sent once its channel is closed.
+type blockPeer struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	asked  []string
+	dnodes []string // asked for with ReqDNode
+	hold   map[string]chan bool
+}
+
+func (p *blockPeer) ReqData(encrypted *[]byte, res *[]byte) error {
+	r := accept_request(*encrypted)
+	if ch := p.hold[r.Sig]; ch != nil {
+		<-ch
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.asked = append(p.asked, r.Sig)
+	if b, ok := p.blocks[r.Sig]; ok {
+		*res = prepare_response(true, 2, b, nil)
+	} else {
+		*res = prepare_response(false, 2, nil, nil)
+	}
+	return nil
+}
+
+func (p *blockPeer) ReqDNode(encrypted *[]byte, res *[]byte) error {
+	r := accept_request(*encrypted)
+	p.mu.Lock()
+	p.dnodes = append(p.dnodes, r.Sig)
+	p.mu.Unlock()
+	if ch := p.hold[r.Sig]; ch != nil {
+		<-ch
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.blocks[r.Sig]; ok {
+		var n DNode
+		json.Unmarshal(b, &n)
+		*res = prepare_response(true, 2, b, &n)
+	} else {
+		*res = prepare_response(false, 2, nil, nil)
+	}
+	return nil
+}
+
+func (p *blockPeer) requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := p.asked
+	p.asked = nil
+	return l
+}
+
+// Connects replica 2, served by rcvr, as the only other replica.
+func serveReplica(t *testing.T, rcvr interface{}) {
+	t.Helper()
+	AESkey = make([]byte, 16)
+	srv := rpc.NewServer()
+	srv.RegisterName("Node", rcvr)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.Accept(l)
+	c := NewServerConn("127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+	Clients = map[int]*serverConn{2: c}
+}
+
+// Creates name in root holding data, flushed and stored.
+func createFile(t *testing.T, name string, data []byte) *DNode {
+	t.Helper()
+	ctx := context.Background()
+	n, h, err := root.Create(ctx, &fuse.CreateRequest{Name: name, Mode: 0644,
+		Flags: fuse.OpenReadWrite}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 0 {
+		if err := h.(*Handle).Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.(*Handle).Flush(ctx, &fuse.FlushRequest{})
+	h.(*Handle).Release(ctx, &fuse.ReleaseRequest{})
+	flushRoot()
+	return n.(*DNode)
+}
+
+// A read at an offset fetches the chunks it overlaps and no others, and
+// keeps them.
+func TestReadFetchesOverlap(t *testing.T) {
+	testFS(t)
+	peer := &blockPeer{blocks: make(map[string][]byte)}
+	serveReplica(t, peer)
+	data := noise(1, 1<<20)
+	n := createFile(t, "f", data)
+	if len(n.DataBlocks) < 8 {
+		t.Fatalf("only %d chunks", len(n.DataBlocks))
+	}
+	for _, sig := range n.DataBlocks {
+		peer.blocks[sig] = getBlock(sig)
+		db.Delete(sig)
+	}
+	restart()
+
+	ctx := context.Background()
+	n = lookup(t, root, "f")
+	h, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*Handle).Release(ctx, &fuse.ReleaseRequest{})
+	read := func(off, size int) {
+		t.Helper()
+		resp := &fuse.ReadResponse{}
+		if err := h.(*Handle).Read(ctx, &fuse.ReadRequest{Offset: int64(off), Size: size}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(resp.Data, data[off:off+size]) {
+			t.Fatalf("read [%d, +%d): first difference at %d", off, size, firstDiff(resp.Data, data[off:off+size]))
+		}
+	}
+
+	off, size := len(data)/2, 8192
+	read(off, size)
+	want := make(map[string]bool)
+	start := 0
+	for i, l := range n.BlockLens {
+		if start < off+size && start+int(l) > off {
+			want[n.DataBlocks[i]] = true
+		}
+		start += int(l)
+	}
+	asked := peer.requests()
+	if len(asked) != len(want) {
+		t.Fatalf("fetched %d chunks for a read overlapping %d", len(asked), len(want))
+	}
+	for _, sig := range asked {
+		if !want[sig] {
+			t.Fatalf("fetched %s, outside the read", sig)
+		}
+	}
+
+	read(off, size)
+	if asked := peer.requests(); len(asked) != 0 {
+		t.Fatalf("fetched %d chunks again", len(asked))
+	}
+}
+
+// A block that doesn't match its hash is never read as the file's data:
+// the read fails with EIO, and nothing is stored.
+func TestReadBadBlock(t *testing.T) {
+	testFS(t)
+	peer := &blockPeer{blocks: make(map[string][]byte)}
+	serveReplica(t, peer)
+	data := noise(1, 64<<10)
+	n := createFile(t, "f", data)
+	for _, sig := range n.DataBlocks {
+		peer.blocks[sig] = getBlock(sig)
+		db.Delete(sig)
+	}
+	bad := n.DataBlocks[0]
+	forged := append([]byte(nil), peer.blocks[bad]...)
+	forged[0] ^= 1
+	peer.blocks[bad] = forged
+	restart()
+
+	stats.Lock()
+	before := stats.BadFetches
+	stats.Unlock()
+	ctx := context.Background()
+	h, err := lookup(t, root, "f").Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*Handle).Release(ctx, &fuse.ReleaseRequest{})
+	resp := &fuse.ReadResponse{}
+	if err := h.(*Handle).Read(ctx, &fuse.ReadRequest{Size: len(data)}, resp); err != fuse.EIO {
+		t.Fatalf("read %d bytes of a forged block: %v", len(resp.Data), err)
+	}
+	if db.Has(bad) {
+		t.Fatal("forged block stored")
+	}
+	stats.Lock()
+	counted := stats.BadFetches - before
+	stats.Unlock()
+	if counted == 0 {
+		t.Fatal("mismatch not counted")
+	}
+
+	// the rest of the file still reads
+	l := int(n.BlockLens[0])
+	resp = &fuse.ReadResponse{}
+	if err := h.(*Handle).Read(ctx, &fuse.ReadRequest{Offset: int64(l), Size: len(data) - l}, resp); err != nil || !bytes.Equal(resp.Data, data[l:]) {
+		t.Fatalf("read past the forged block: %d bytes, %v", len(resp.Data), err)
+	}
+}
@@ -0,0 +1,228 @@
+package dfs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Starts over from what's stored, as a replica does when it restarts.
+func restart() {
+	nodeMap = make(map[uint64]*DNode)
+	loadRoot()
+}
+
+// The version of stored node sig that replica 2 would send after writing
+// data to it.
+func remoteEdit(sig string, data []byte) DNode {
+	n := *getDNode(sig)
+	n.setExtents(putBlocks(data))
+	n.Attrs.Size = uint64(len(data))
+	n.Attrs.Mtime = time.Now()
+	n.Owner = 2
+	n.Version++
+	n.PrevSig = sig
+	n.VV = n.VV.bump(2)
+	return n
+}
+
+func lookup(t *testing.T, dir *DNode, name string) *DNode {
+	t.Helper()
+	n, err := dir.Lookup(context.Background(), &fuse.LookupRequest{Name: name}, &fuse.LookupResponse{})
+	if err != nil {
+		t.Fatalf("lookup %s: %v", name, err)
+	}
+	return n.(*DNode)
+}
+
+func contents(t *testing.T, n *DNode) []byte {
+	t.Helper()
+	ctx := context.Background()
+	h, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &fuse.ReadResponse{}
+	if err := h.(*Handle).Read(ctx, &fuse.ReadRequest{Size: int(n.Attrs.Size) + 1}, resp); err != nil {
+		t.Fatal(err)
+	}
+	h.(*Handle).Release(ctx, &fuse.ReleaseRequest{})
+	return resp.Data
+}
+
+// Names in root that are conflict copies of name.
+func conflictCopies(name string) (l []string) {
+	meta.Lock()
+	defer meta.Unlock()
+	for k := range root.kids {
+		if strings.HasPrefix(k, name+CONFLICT) {
+			l = append(l, k)
+		}
+	}
+	for k := range root.ChildSigs {
+		if _, ok := root.kids[k]; !ok && strings.HasPrefix(k, name+CONFLICT) {
+			l = append(l, k)
+		}
+	}
+	return l
+}
+
+// f is ours, which has more flushes behind it so wins, and theirs is
+// kept next to it.
+func keptBoth(t *testing.T, ours, theirs []byte) {
+	t.Helper()
+	if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, ours) {
+		t.Fatalf("f has %d bytes, not ours", len(got))
+	}
+	copies := conflictCopies("f")
+	if len(copies) != 1 {
+		t.Fatalf("%d conflict copies, want 1", len(copies))
+	}
+	if got := contents(t, lookup(t, root, copies[0])); !bytes.Equal(got, theirs) {
+		t.Fatalf("%s has %d bytes, not theirs", copies[0], len(got))
+	}
+}
+
+func TestReceiveNode(t *testing.T) {
+	ours, theirs := noise(1, 3000), noise(2, 4000)
+	// f written and flushed here, as replica 1
+	setup := func() (sig string) {
+		f := newSparseFile(t)
+		f.write(0, noise(0, 2000))
+		f.flush()
+		flushRoot()
+		return root.ChildSigs["f"]
+	}
+
+	t.Run("newer, not loaded", func(t *testing.T) {
+		sig := setup()
+		restart()
+		if !receiveNode(remoteEdit(sig, theirs)) {
+			t.Fatal("not stored")
+		}
+		if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, theirs) {
+			t.Fatal("newer version not applied")
+		}
+	})
+
+	t.Run("flushed offline, not loaded", func(t *testing.T) {
+		sig := setup()
+		f := lookup(t, root, "f")
+		f.lock()
+		meta.Lock()
+		f.setExtents(putBlocks(ours))
+		f.Attrs.Size = uint64(len(ours))
+		markDirty(f)
+		meta.Unlock()
+		f.unlock()
+		flushRoot()
+		restart()
+		receiveNode(remoteEdit(sig, theirs))
+		keptBoth(t, ours, theirs)
+	})
+
+	t.Run("unflushed writes", func(t *testing.T) {
+		f := newSparseFile(t)
+		f.write(0, noise(0, 2000))
+		f.flush()
+		flushRoot()
+		sig := root.ChildSigs["f"]
+		f.write(0, ours) // open, not flushed
+		receiveNode(remoteEdit(sig, theirs))
+		keptBoth(t, ours, theirs)
+	})
+
+	t.Run("new entry not flushed", func(t *testing.T) {
+		setup()
+		rsig := head.Root
+		ctx := context.Background()
+		if _, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "g", Mode: 0644}, &fuse.CreateResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		r := *getDNode(rsig)
+		r.ChildSigs = map[string]string{"f": r.ChildSigs["f"], "h": putBlock(Marshal(&DNode{Name: "h"}))}
+		r.VV = r.VV.bump(2)
+		r.Owner = 2
+		receiveNode(r)
+		for _, name := range []string{"f", "g", "h"} {
+			lookup(t, root, name)
+		}
+	})
+}
+
+// A merge that needs a node from a slow replica fetches it before taking
+// the tree, so other operations carry on meanwhile.
+func TestReceiveFetchesFirst(t *testing.T) {
+	testFS(t)
+	peer := &blockPeer{blocks: make(map[string][]byte), hold: make(map[string]chan bool)}
+	serveReplica(t, peer)
+	f := createFile(t, "f", noise(1, 1000))
+	createFile(t, "g", noise(2, 1000))
+	rootSig := head.Root
+
+	// replica 2 writes f, and the root it's in, from there; we write f
+	// here meanwhile
+	theirsF := remoteEdit(f.sig, noise(3, 1000))
+	fSig := putBlock(Marshal(theirsF))
+	theirs := *getDNode(rootSig)
+	theirs.ChildSigs = map[string]string{"f": fSig, "g": theirs.ChildSigs["g"]}
+	theirs.Owner = 2
+	theirs.Version++
+	theirs.PrevSig = rootSig
+	theirs.VV = theirs.VV.bump(2)
+	for _, sig := range append([]string{fSig}, theirsF.DataBlocks...) {
+		peer.blocks[sig] = getBlock(sig)
+		db.Delete(sig)
+	}
+	f.lock()
+	meta.Lock()
+	f.setExtents(putBlocks(noise(4, 1000)))
+	markDirty(f)
+	meta.Unlock()
+	f.unlock()
+	flushRoot()
+	oursSig := root.ChildSigs["f"]
+	release := make(chan bool)
+	peer.hold[fSig] = release
+
+	acked := make(chan bool)
+	go func() { acked <- receiveNode(theirs) }()
+	for asked := false; !asked; time.Sleep(time.Millisecond) {
+		peer.mu.Lock()
+		asked = len(peer.dnodes) > 0
+		peer.mu.Unlock()
+	}
+	done := make(chan bool)
+	go func() {
+		contents(t, lookup(t, root, "g"))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading g waited for the fetch")
+	}
+	close(release)
+	if !<-acked {
+		t.Fatal("not applied")
+	}
+	if getDNode(fSig) == nil {
+		t.Fatal("their f wasn't fetched")
+	}
+
+	// the entry is picked by f's versions, both of which are here now
+	want := oursSig
+	if theirsF.VV.wins(getDNode(oursSig).VV) {
+		want = fSig
+	}
+	meta.Lock()
+	got := root.ChildSigs["f"]
+	meta.Unlock()
+	if got != want {
+		t.Fatalf("merged f to %s, want %s", got, want)
+	}
+}
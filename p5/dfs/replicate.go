@@ -0,0 +1,286 @@
+package dfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//=============================================================================
+// Replication. Every DNode a flush writes goes to each other replica in
+// flush order, and stays queued for it until it says it's stored the
+// node and every chunk the node points at (Receive fetches those before
+// answering). A replica that's down gets its queue when it's back.
+//
+// Messages are numbered. Once WriteQuorum replicas, this one included,
+// have everything up to a number, it's committed; fsync waits for its
+// flush to be, and fails with EIO if it can't be yet. Heartbeats (the
+// root, when nothing's changed) aren't queued, numbered or retried.
+
+var WriteQuorum = 1 // replicas, this one included, a flush is committed on
+
+type outMsg struct {
+	seq       uint64
+	buf       []byte
+	heartbeat bool
+}
+
+type peerQueue struct {
+	pending []outMsg // not yet acknowledged, in order
+	acked   uint64   // every message up to here is stored there, unless resync
+	fails   int      // sends failed in a row
+	resync  bool     // messages up to dropped were never sent, so acked means
+	dropped uint64   // nothing until anti-entropy has caught it up past them
+	lastErr error
+	lastAck time.Time
+
+	lastSync time.Time // last anti-entropy pass with it, see entropy.go
+	syncOK   bool
+	pulled   int // nodes that pass brought over
+}
+
+var repl struct {
+	sync.Mutex
+	seq       uint64 // last message numbered
+	committed uint64
+	peers     map[int]*peerQueue
+}
+
+// One send at a time, so each replica gets messages in order.
+var sendMu sync.Mutex
+
+// Updates kept for a replica that's down; past that the oldest go, and
+// it catches up through anti-entropy instead. Until it has, it doesn't
+// count towards WriteQuorum.
+const MAXQUEUE = 10000
+
+func peerQ(pid int) *peerQueue {
+	if repl.peers == nil {
+		repl.peers = make(map[int]*peerQueue)
+	}
+	q := repl.peers[pid]
+	if q == nil {
+		q = new(peerQueue)
+		repl.peers[pid] = q
+	}
+	return q
+}
+
+// Sends the outbox, and whatever earlier sends didn't get through, to the
+// other replicas, and returns the last message number handed out and
+// whether it's committed. Called with no locks held, as their Receive may
+// be waiting on a request of theirs that's waiting on us.
+func sendOutbox() (uint64, bool) {
+	sendMu.Lock()
+	outbox.Lock()
+	msgs := outbox.msgs
+	outbox.msgs = nil
+	outbox.Unlock()
+
+	peers := clients()
+	repl.Lock()
+	var beat []byte
+	for _, m := range msgs {
+		if m.heartbeat {
+			beat = m.buf
+			continue
+		}
+		repl.seq++
+		m.seq = repl.seq
+		for pid := range peers {
+			q := peerQ(pid)
+			q.pending = append(q.pending, m)
+			if len(q.pending) > MAXQUEUE {
+				if !q.resync {
+					p_err("replica %d: %d updates queued, dropping the oldest until it resyncs\n", pid, MAXQUEUE)
+				}
+				q.resync, q.dropped = true, q.pending[0].seq
+				q.pending = q.pending[1:]
+			}
+		}
+	}
+	last := repl.seq
+	work := make(map[int][]outMsg)
+	for pid := range peers {
+		q := peerQ(pid)
+		work[pid] = q.pending
+		if len(q.pending) == 0 && beat != nil {
+			work[pid] = []outMsg{{buf: beat, heartbeat: true}}
+		}
+	}
+	repl.Unlock()
+
+	var wg sync.WaitGroup
+	for pid, l := range work {
+		if len(l) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(pid int, l []outMsg) {
+			defer wg.Done()
+			sendTo(peers[pid], pid, l)
+		}(pid, l)
+	}
+	wg.Wait()
+
+	repl.Lock()
+	updateCommitted()
+	ok := repl.committed >= last
+	repl.Unlock()
+	sendMu.Unlock()
+	return last, ok
+}
+
+// Sends l to pid in order, stopping at the first that doesn't get stored.
+func sendTo(c *serverConn, pid int, l []outMsg) {
+	var err error
+	var acked uint64
+	for _, m := range l {
+		var enc_reply []byte
+		req := aesEncrypt(AESkey, m.buf)
+		if err = c.Call("Node.Receive", &req, &enc_reply); err != nil {
+			break
+		}
+		if reply := accept_response(enc_reply); !reply.Ack {
+			err = fmt.Errorf("not stored")
+			break
+		}
+		acked = m.seq
+	}
+
+	repl.Lock()
+	q := peerQ(pid)
+	if acked > q.acked {
+		q.acked = acked
+		q.lastAck = time.Now()
+	}
+	for len(q.pending) > 0 && q.pending[0].seq <= q.acked {
+		q.pending = q.pending[1:]
+	}
+	switch {
+	case err != nil && q.fails == 0:
+		p_err("replica %d: %v, %d updates queued\n", pid, err, len(q.pending))
+	case err == nil && q.fails > 0:
+		p_err("replica %d back after %d failed sends\n", pid, q.fails)
+	}
+	if err != nil {
+		q.fails++
+	} else {
+		q.fails = 0
+	}
+	q.lastErr = err
+	repl.Unlock()
+}
+
+func peerPids() []int {
+	var pids []int
+	for pid := range clients() {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+func syncDone(pid, pulled int, ok bool) {
+	repl.Lock()
+	q := peerQ(pid)
+	q.lastSync, q.syncOK, q.pulled = time.Now(), ok, pulled
+	repl.Unlock()
+}
+
+// Anti-entropy found pid's root covers ours as of message seq, so it has
+// everything up to there, whatever was dropped from its queue.
+func caughtUp(pid int, seq uint64) {
+	repl.Lock()
+	q := peerQ(pid)
+	if seq > q.acked {
+		q.acked = seq
+	}
+	for len(q.pending) > 0 && q.pending[0].seq <= q.acked {
+		q.pending = q.pending[1:]
+	}
+	if q.resync && seq >= q.dropped {
+		q.resync = false
+		p_err("replica %d resynced\n", pid)
+	}
+	updateCommitted()
+	repl.Unlock()
+}
+
+// The highest message on WriteQuorum replicas. Caller holds repl.
+func updateCommitted() {
+	need := WriteQuorum - 1 // besides us
+	if need <= 0 {
+		repl.committed = repl.seq
+		return
+	}
+	var acks []uint64
+	for pid := range clients() {
+		if q := peerQ(pid); !q.resync {
+			acks = append(acks, q.acked)
+		}
+	}
+	if len(acks) < need {
+		return // never, with these replicas
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i] > acks[j] })
+	if acks[need-1] > repl.committed {
+		repl.committed = acks[need-1]
+	}
+}
+
+// Fetches whatever chunks of n aren't here yet; false if some can't be.
+func (n *DNode) haveBlocks() bool {
+	var want []int
+	for i, sig := range n.DataBlocks {
+		if sig != "" && !db.Has(sig) {
+			want = append(want, i)
+		}
+	}
+	for j, blk := range n.fetchBlocks(want) {
+		if blk == nil {
+			p_err("Receive: chunk %s of %q missing\n", n.DataBlocks[want[j]], n.Name)
+			return false
+		}
+	}
+	return true
+}
+
+// "repl": what each replica has acknowledged, and what's still queued.
+func cmdRepl(args []string) (string, error) {
+	var buf bytes.Buffer
+	repl.Lock()
+	fmt.Fprintf(&buf, "write quorum %d of %d, %d updates, %d committed\n",
+		WriteQuorum, len(clients())+1, repl.seq, repl.committed)
+	for _, pid := range peerPids() {
+		q := peerQ(pid)
+		state := "ok"
+		if q.lastErr != nil {
+			state = fmt.Sprintf("failing (%d sends): %v", q.fails, q.lastErr)
+		}
+		if q.resync {
+			state += fmt.Sprintf(", needs resync (updates to %d dropped), not in the quorum", q.dropped)
+		}
+		name := ""
+		if r := replica(pid); r != nil {
+			name = r.Name
+		}
+		ack := "never"
+		if !q.lastAck.IsZero() {
+			ack = q.lastAck.Format(time.Stamp)
+		}
+		fmt.Fprintf(&buf, "%3d %-10s acked %d (%s), %d queued, %s\n",
+			pid, name, q.acked, ack, len(q.pending), state)
+		switch {
+		case q.lastSync.IsZero():
+		case q.syncOK:
+			fmt.Fprintf(&buf, "    synced %s, %d nodes pulled\n", q.lastSync.Format(time.Stamp), q.pulled)
+		default:
+			fmt.Fprintf(&buf, "    sync failed %s\n", q.lastSync.Format(time.Stamp))
+		}
+	}
+	repl.Unlock()
+	return buf.String(), nil
+}
@@ -0,0 +1,73 @@
+package dfs
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+// Stores whatever it's sent.
+type ackPeer struct{ got int }
+
+func (p *ackPeer) Receive(encrypted *[]byte, rep *[]byte) error {
+	p.got++
+	*rep = prepare_response(true, 2, nil, nil)
+	return nil
+}
+
+// A replica that had updates dropped from its queue doesn't count towards
+// the quorum, whatever it acknowledges after, until it's resynced.
+func TestDroppedUpdatesLeaveQuorum(t *testing.T) {
+	testFS(t)
+	AESkey = make([]byte, 16)
+	repl.seq, repl.committed, repl.peers = 0, 0, nil
+	defer func(w int) { WriteQuorum = w }(WriteQuorum)
+	WriteQuorum = 2
+
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	Clients = map[int]*serverConn{2: NewServerConn("127.0.0.1", dead.Addr().(*net.TCPAddr).Port)}
+	dead.Close()
+	queue := func(n int) {
+		outbox.Lock()
+		for i := 0; i < n; i++ {
+			outbox.msgs = append(outbox.msgs, outMsg{buf: []byte("{}")})
+		}
+		outbox.Unlock()
+	}
+	queue(MAXQUEUE + 5)
+	if _, ok := sendOutbox(); ok {
+		t.Fatal("committed with the only other replica down")
+	}
+
+	peer := &ackPeer{}
+	srv := rpc.NewServer()
+	srv.RegisterName("Node", peer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(l)
+	Clients = map[int]*serverConn{2: NewServerConn("127.0.0.1", l.Addr().(*net.TCPAddr).Port)}
+	queue(1)
+	last, ok := sendOutbox()
+	if peer.got != MAXQUEUE {
+		t.Fatalf("sent %d, want the %d kept", peer.got, MAXQUEUE)
+	}
+	if ok || repl.committed != 0 {
+		t.Fatalf("committed %d (of %d) without the dropped updates", repl.committed, last)
+	}
+	if out, _ := cmdRepl(nil); !strings.Contains(out, "needs resync") {
+		t.Fatal("repl doesn't say so:\n", out)
+	}
+
+	caughtUp(2, last)
+	if repl.committed != last || peerQ(2).resync {
+		t.Fatalf("after resync: committed %d of %d", repl.committed, last)
+	}
+	queue(1)
+	if last, ok := sendOutbox(); !ok || repl.committed != last {
+		t.Fatal("not committed after resync")
+	}
+}
@@ -0,0 +1,276 @@
+package dfs
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//=============================================================================
+// Retention of version history.
+//
+// Each flushed root is a version of the whole file system, linked to the
+// one before through PrevSig. A policy picks the versions to keep; the
+// chain is relinked through just those (rewriting the kept roots whose
+// PrevSig changes) and gc() then frees everything else.
+//
+// A policy is a list of rules separated by '/', set per replica in
+// config.txt (e.g. "retain=10/2h/1h:24/1d:30"):
+//
+//	N        keep the N newest versions
+//	<dur>    keep every version younger than dur
+//	<dur>:N  keep the newest version in each of the N most recent
+//	         dur-sized periods that have one (hourly, daily, ...)
+//
+// Durations are Go durations, plus "d" for days and "w" for weeks. The
+// current version and snapshotted versions are always kept.
+
+type retainRule struct {
+	count int
+	dur   time.Duration
+}
+
+type Retention []retainRule
+
+var retention Retention
+var PrunePeriod = time.Hour
+var lastPrune = time.Now()
+
+func parseDur(s string) (time.Duration, error) {
+	mult := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		mult = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		mult = 7 * 24 * time.Hour
+	}
+	if mult != 0 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		return time.Duration(n) * mult, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("bad duration %q", s)
+	}
+	return d, err
+}
+
+func fmtDur(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func ParseRetention(s string) (Retention, error) {
+	var r Retention
+	for _, tok := range strings.Split(s, "/") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+		var rule retainRule
+		var err error
+		parts := strings.SplitN(tok, ":", 2)
+		if n, cerr := strconv.Atoi(parts[0]); cerr == nil && len(parts) == 1 {
+			rule.count = n
+			if n <= 0 {
+				err = fmt.Errorf("bad count")
+			}
+		} else {
+			rule.dur, err = parseDur(parts[0])
+			if err == nil && len(parts) == 2 {
+				rule.count, err = strconv.Atoi(parts[1])
+				if err == nil && rule.count <= 0 {
+					err = fmt.Errorf("bad count")
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("retention rule %q: %v", tok, err)
+		}
+		r = append(r, rule)
+	}
+	return r, nil
+}
+
+func (r Retention) String() string {
+	var toks []string
+	for _, rule := range r {
+		switch {
+		case rule.dur == 0:
+			toks = append(toks, strconv.Itoa(rule.count))
+		case rule.count == 0:
+			toks = append(toks, fmtDur(rule.dur))
+		default:
+			toks = append(toks, fmt.Sprintf("%s:%d", fmtDur(rule.dur), rule.count))
+		}
+	}
+	return strings.Join(toks, "/")
+}
+
+type rootVersion struct {
+	sig string
+	n   *DNode
+}
+
+// The root chain, newest first, as far back as it's stored.
+func rootHistory() (vs []rootVersion) {
+	for sig := head.Root; sig != ""; {
+		n := getDNode(sig)
+		if n == nil {
+			break
+		}
+		vs = append(vs, rootVersion{sig, n})
+		sig = n.PrevSig
+	}
+	return
+}
+
+// Which of vs (newest first) the policy keeps.
+func (r Retention) keep(vs []rootVersion, now time.Time) []bool {
+	keep := make([]bool, len(vs))
+	if len(vs) > 0 {
+		keep[0] = true
+	}
+	for _, rule := range r {
+		switch {
+		case rule.dur == 0:
+			for i := 0; i < rule.count && i < len(vs); i++ {
+				keep[i] = true
+			}
+		case rule.count == 0:
+			for i, v := range vs {
+				if now.Sub(v.n.Attrs.Atime) < rule.dur {
+					keep[i] = true
+				}
+			}
+		default:
+			var last time.Time
+			buckets := 0
+			for i, v := range vs {
+				b := v.n.Attrs.Atime.Truncate(rule.dur)
+				if buckets > 0 && b.Equal(last) {
+					continue
+				}
+				if buckets == rule.count {
+					break
+				}
+				last = b
+				buckets++
+				keep[i] = true
+			}
+		}
+	}
+	return keep
+}
+
+// Relinks the root chain through the versions r keeps and points the
+// head at the result. Returns how many versions were dropped. Must be
+// called with the lock held, or on an unmounted store.
+func (r Retention) prune(now time.Time, dryRun bool) (dropped int) {
+	if root != nil && root.metaDirty {
+		flushRoot()
+	}
+	vs := rootHistory()
+	keep := r.keep(vs, now)
+	pinned := pinnedRoots()
+	var kept []rootVersion
+	for i, v := range vs {
+		if keep[i] || pinned[v.sig] != nil {
+			kept = append(kept, v)
+		}
+	}
+	dropped = len(vs) - len(kept)
+	if dropped == 0 || dryRun {
+		return
+	}
+
+	// oldest first, so each rewrite knows its predecessor's new sig
+	prev := ""
+	for i := len(kept) - 1; i >= 0; i-- {
+		v := kept[i]
+		if v.n.PrevSig != prev {
+			v.n.PrevSig = prev
+			old := v.sig
+			v.sig = putBlock(Marshal(v.n))
+			repinSnapshots(pinned[old], v.sig)
+		}
+		prev = v.sig
+	}
+	p_out("prune: dropped %d of %d versions, root %s -> %s\n", dropped, len(vs), head.Root, prev)
+	head.Root = prev
+	head.NextInd = nextInd
+	putBlockSig("head", Marshal(head))
+	if root != nil && MountSnapshot == "" {
+		root.PrevSig = prev
+		root.sig = prev
+	}
+	return
+}
+
+// "prune [-n] [policy]": apply the retention policy (the replica's, or the
+// one given) and collect the dropped versions.
+func cmdPrune(args []string) (string, error) {
+	dryRun := false
+	r := retention
+	for _, a := range args {
+		if a == "-n" {
+			dryRun = true
+			continue
+		}
+		var err error
+		if r, err = ParseRetention(a); err != nil {
+			return "", err
+		}
+	}
+	if len(r) == 0 {
+		return "", fmt.Errorf("no retention policy (set retain= in config.txt)")
+	}
+
+	var buf bytes.Buffer
+	dropped := r.prune(time.Now(), dryRun)
+	if dryRun {
+		buf.WriteString("(dry run) ")
+	}
+	fmt.Fprintf(&buf, "prune %s: dropped %d versions\n", r, dropped)
+	if dryRun {
+		return buf.String(), nil
+	}
+	res, err := gc(true, false)
+	buf.WriteString(res.String())
+	return buf.String(), err
+}
+
+// The replica's policy, from retain= in config.txt.
+func initRetention() {
+	if Merep == nil || Merep.Opts["retain"] == "" {
+		return
+	}
+	var err error
+	retention, err = ParseRetention(Merep.Opts["retain"])
+	p_dieif(err != nil, "%v\n", err)
+	p_out("retention policy %s\n", retention)
+}
+
+// Called by the Flusher, which holds no locks; takes the tree if it's
+// time.
+func autoPrune() {
+	if len(retention) == 0 || time.Since(lastPrune) < PrunePeriod {
+		return
+	}
+	in()
+	defer out()
+	lastPrune = time.Now()
+	if dropped := retention.prune(lastPrune, false); dropped > 0 {
+		res, err := gc(true, false)
+		if err != nil {
+			p_err("gc after prune: %v\n", err)
+		}
+		p_out("prune: dropped %d versions, %s", dropped, res)
+	}
+}
@@ -0,0 +1,125 @@
+package dfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetentionKeep(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 30, 0, 0, time.UTC)
+	// newest first: now, 1h, 2h, ... 47h ago
+	var vs []rootVersion
+	for i := 0; i < 48; i++ {
+		n := new(DNode)
+		n.Attrs.Atime = now.Add(-time.Duration(i) * time.Hour)
+		vs = append(vs, rootVersion{fmt.Sprint(i), n})
+	}
+	for policy, want := range map[string][]int{
+		"3":         {0, 1, 2},
+		"150m":      {0, 1, 2},
+		"1d:2":      {0, 13},
+		"2/6h:3":    {0, 1, 7}, // 12:00, 06:00 and 00:00 periods
+		"7d":        nil,       // all of them
+		"10/1h:100": nil,
+	} {
+		r, err := ParseRetention(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r2, err := ParseRetention(r.String()); err != nil || fmt.Sprint(r2) != fmt.Sprint(r) {
+			t.Fatalf("%q prints as %q", policy, r)
+		}
+		var got []int
+		for i, k := range r.keep(vs, now) {
+			if k {
+				got = append(got, i)
+			}
+		}
+		if want == nil {
+			for i := range vs {
+				want = append(want, i)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%q keeps %v, want %v", policy, got, want)
+		}
+	}
+	for _, bad := range []string{"0", "x", "1h:0", "-1h", "2d:x"} {
+		if _, err := ParseRetention(bad); err == nil {
+			t.Fatalf("parsed %q", bad)
+		}
+	}
+}
+
+// Pruning keeps what the policy picks, and gc then frees what only the
+// dropped versions had.
+func TestPruneThenGC(t *testing.T) {
+	f := newSparseFile(t)
+	type version struct {
+		root, file string
+		blocks     []string
+		n          uint64
+	}
+	var vs []version
+	for i := 0; i < 4; i++ {
+		f.write(0, noise(int64(i), 5000))
+		f.flush()
+		flushRoot()
+		vs = append(vs, version{head.Root, f.n.sig, f.n.DataBlocks, root.Version})
+	}
+	before := make(map[string]bool)
+	db.Keys("", func(key string, size int) bool {
+		before[key] = true
+		return true
+	})
+	// everything the versions before the newest two have
+	old := make(map[string]bool)
+	for _, v := range rootHistory()[2:] {
+		markTree(v.sig, old)
+	}
+
+	r, _ := ParseRetention("2")
+	if dropped := r.prune(time.Now(), false); dropped == 0 {
+		t.Fatal("nothing pruned")
+	}
+	hist := rootHistory()
+	if len(hist) != 2 || hist[0].n.Version != vs[3].n || hist[1].n.Version != vs[2].n {
+		t.Fatalf("kept %d versions", len(hist))
+	}
+	if _, err := gc(true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the kept versions are whole
+	for _, v := range hist {
+		live := make(map[string]bool)
+		markTree(v.sig, live)
+		for sig := range live {
+			if !db.Has(sig) {
+				t.Fatalf("kept version %s lost %s", v.sig, sig)
+			}
+		}
+	}
+	for _, v := range vs[2:] {
+		for _, sig := range append([]string{v.file}, v.blocks...) {
+			if !db.Has(sig) {
+				t.Fatalf("kept file version lost %s", sig)
+			}
+		}
+	}
+	// the dropped ones are gone, and nothing they didn't have
+	for _, v := range vs[:2] {
+		for _, sig := range append([]string{v.root, v.file}, v.blocks...) {
+			if db.Has(sig) {
+				t.Fatalf("dropped version's %s still stored", sig)
+			}
+		}
+	}
+	for key := range before {
+		// the kept roots are rewritten with new PrevSigs
+		if !db.Has(key) && !old[key] && key != vs[2].root && key != vs[3].root {
+			t.Fatalf("gc freed %s, which only kept versions had", key)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,6 +34,7 @@ type Replica struct {
 	Db    string
 	Addr  string
 	Port  int
+	Opts  map[string]string // trailing key=value fields in config.txt
 }
 
 func (r *Replica) String() string {
@@ -41,11 +43,21 @@ func (r *Replica) String() string {
 }
 
 type serverConn struct {
-	conn *rpc.Client
-	port int
-	Addr string
+	mu      sync.Mutex // guards conn, down and dialing; Call is used concurrently
+	conn    *rpc.Client
+	port    int
+	Addr    string
+	down    time.Time // don't redial before this
+	dialing bool      // a background dial is under way
 }
 
+// How long a replica that can't be reached is skipped for, and how long
+// each dial may take.
+const (
+	DOWNTIME    = 10 * time.Second
+	DIALTIMEOUT = 2 * time.Second
+)
+
 func (s *serverConn) String() string {
 	return fmt.Sprintf("port: [%d] addr: [%s]\n", s.port, s.Addr)
 }
@@ -105,9 +117,10 @@ func (nd *Node) Authenticate(r *[]byte, reply *Response) error {
 func (nd *Node) ReqToken(encrypted *[]byte, res *[]byte) error {
 	if Token {
 		*res = prepare_response(true, Merep.Pid, nil, nil)
-		in()
+		tree.RLock()
 		flushRoot()
-		out()
+		tree.RUnlock()
+		sendOutbox()
 		Token = false
 	} else {
 		p_out("I don't have the token (%d)\n", Merep.Pid)
@@ -117,12 +130,16 @@ func (nd *Node) ReqToken(encrypted *[]byte, res *[]byte) error {
 	return nil
 }
 
+// The DNode, and the block it's stored as.
 func (nd *Node) ReqDNode(encrypted *[]byte, res *[]byte) error {
 	p_out("\n\nREQUEST DNODE!\n\n")
 	r := accept_request(*encrypted)
-	n := getDNode(r.Sig)
-	*res = prepare_response(true, Merep.Pid, nil, n)
-
+	if b := getBlock(r.Sig); b != nil {
+		n := getDNode(r.Sig)
+		*res = prepare_response(n != nil, Merep.Pid, b, n)
+	} else {
+		*res = prepare_response(false, Merep.Pid, nil, nil)
+	}
 	return nil
 }
 
@@ -141,64 +158,358 @@ func (nd *Node) Receive(encrypted *[]byte, rep *[]byte) error {
 	decrypted := AESDecrypt(AESkey, *encrypted)
 	var n DNode
 	json.Unmarshal(decrypted, &n)
-	if n.Attrs.Atime.Before(root.Attrs.Atime.Add((1 * time.Millisecond))) {
-		return nil
+	if c := clients()[n.Owner]; c != nil {
+		c.connect() // so receiveNode can fetch what it's missing
+	}
+	*rep = prepare_response(receiveNode(n), Merep.Pid, nil, nil)
+	return nil
+}
+
+// Applies another replica's version of a node, if it's newer than ours,
+// and returns whether we've now got it (or something newer) stored.
+// Ours is the one in memory, or else the one stored (see storedNode);
+// if it has changes not flushed yet, they're flushed first, so they're
+// a version of their own that's compared like any other rather than
+// overwritten. Called with no locks held.
+func receiveNode(n DNode) bool {
+	// acknowledging it means we have everything it points at, and gc
+	// mustn't take any of it before it's applied. Whatever we have to
+	// fetch is fetched first, so a slow replica doesn't hold the tree.
+	var entries []string
+	if n.Attrs.Mode.IsDir() {
+		entries = n.mergeEntries()
+	}
+	pinned := append(entries, n.DataBlocks...)
+	pin(pinned)
+	defer unpin(pinned)
+	if !n.haveBlocks() {
+		return false
+	}
+	n.haveEntries(entries)
+	in()
+	taken := false
+	var kids map[string]*DNode
+	if local := storedNode(n.Attrs.Inode); local != nil {
+		c := n.VV.compare(local.VV)
+		if c != VV_EQUAL && c != VV_OLDER && local.unflushed() {
+			local.lock()
+			local.flushData()
+			local.unlock()
+			flushRoot()
+			c = n.VV.compare(local.VV)
+		}
+		switch c {
+		case VV_EQUAL, VV_OLDER:
+			out()
+			return true
+		case VV_CONCURRENT:
+			theirsWin := n.VV.wins(local.VV)
+			if local.Attrs.Mode.IsDir() && n.Attrs.Mode.IsDir() {
+				sent := n
+				kids = mergeDir(local, &n)
+				if !theirsWin && sameEntries(&n, local) {
+					local.VV = n.VV
+					out()
+					return true
+				}
+				// flushed again unless it's just what they sent
+				taken = !theirsWin || !sameEntries(&n, &sent)
+				p_out("Receive: %q concurrent with ours, merged\n", n.Name)
+				break
+			}
+			if !theirsWin {
+				p_out("Receive: %q concurrent with ours, keeping ours\n", n.Name)
+				local.VV = local.VV.merge(n.VV)
+				keepConflict(local, &n)
+				out()
+				return true
+			}
+			p_out("Receive: %q concurrent with ours, taking theirs\n", n.Name)
+			n.VV = n.VV.merge(local.VV)
+			taken = true
+		}
 	}
 	n.PrevSig = putBlock(Marshal(n))
 	n.sig = n.PrevSig
 	n.metaDirty = false
 
-	if n.Attrs.Inode > nextInd {
-		nextInd = n.Attrs.Inode
-	} else if n.Attrs.Inode == nextInd {
-		nextInd++
+	// conflict copies' inodes are in their replica's range, not ours
+	if ino := n.Attrs.Inode; ino>>INOPIDSHIFT == 0 {
+		if ino > nextInd {
+			nextInd = ino
+		} else if ino == nextInd {
+			nextInd++
+		}
 	}
 
-	if n.Version > version {
-		version = n.Version
-	} else if n.Version == version {
-		version++
+	// Lamport: our next flush is numbered after theirs
+	if n.Version >= version {
+		version = n.Version + 1
 	}
 
-	if child, ok := nodeMap[n.Attrs.Inode]; ok { // in map
+	if child := nodeMap[n.Attrs.Inode]; child != nil { // in map
+		n.opens = child.opens
 		*child = n
 		nodeMap[n.Attrs.Inode].ChildSigs = n.ChildSigs
 		nodeMap[n.Attrs.Inode].DataBlocks = n.DataBlocks
+		nodeMap[n.Attrs.Inode].BlockLens = n.BlockLens
 	} else {
 		nodeMap[n.Attrs.Inode] = &n
 	}
 	nodeMap[n.Attrs.Inode].kids = make(map[string]*DNode)
+	if kids != nil {
+		// what we've not flushed yet stays
+		nodeMap[n.Attrs.Inode].kids = kids
+		for _, k := range kids {
+			nodeMap[n.Attrs.Inode].metaDirty = nodeMap[n.Attrs.Inode].metaDirty || k.metaDirty
+		}
+	}
+	if taken {
+		// flushed again with a vector covering both, for the others
+		markDirty(nodeMap[n.Attrs.Inode])
+	}
 
 	if n.Attrs.Inode == root.Attrs.Inode {
 		head.Root = n.PrevSig
 		head.NextInd = nextInd
 		putBlockSig("head", Marshal(head))
 	}
-	*rep = prepare_response(true, Merep.Pid, nil, nil)
+	out()
+	return true
+}
+
+// The entries a merge of directory n with ours might compare (see
+// pickEntry): those of a name, or linked inode, both have but with
+// different nodes.
+func (n *DNode) mergeEntries() (sigs []string) {
+	_, local, inodes, ok := localView(n.Attrs.Inode)
+	if !ok {
+		return nil
+	}
+	add := func(a, b string) {
+		if a != b && !isInoRef(a) && !isInoRef(b) {
+			sigs = append(sigs, a, b)
+		}
+	}
+	for name, b := range n.ChildSigs {
+		if a, ok := local[name]; ok {
+			add(a, b)
+		}
+	}
+	for ino, b := range n.Inodes {
+		if a, ok := inodes[ino]; ok {
+			add(a, b)
+		}
+	}
+	return sigs
+}
 
+// Fetches the DNodes of sigs we haven't got. One nobody has leaves the
+// merge to pick the winner's entry.
+func (n *DNode) haveEntries(sigs []string) {
+	for _, sig := range sigs {
+		if !db.Has(sig) && fetchRemote("Node.ReqDNode", n.Owner, sig) == nil {
+			p_err("Receive: entry %s of %q missing\n", sig, n.Name)
+		}
+	}
+}
+
+// Whether n has changes that aren't in a version yet. Caller holds the
+// tree exclusively.
+func (n *DNode) unflushed() bool {
+	return n.metaDirty || n.dirty || len(n.wins) > 0
+}
+
+// Where each node that's stored but not loaded is: the directory with an
+// entry for it, and the entry's name. Built by walking the stored tree
+// the first time a node comes in that isn't loaded, as after a restart.
+// Whatever's stored since went through nodeMap, so a node that's in
+// neither is new; one that's moved since without being loaded is found
+// by walking again.
+var placeOf map[uint64]place
+
+type place struct {
+	dir  uint64
+	name string
+}
+
+func buildPlaces() {
+	placeOf = make(map[uint64]place)
+	var walk func(d *DNode)
+	walk = func(d *DNode) {
+		meta.Lock()
+		sigs := make(map[string]string, len(d.ChildSigs))
+		for name := range d.ChildSigs {
+			sigs[name], _ = d.childSig(name)
+		}
+		kids := make(map[string]*DNode, len(d.kids))
+		for name, k := range d.kids {
+			kids[name] = k
+			if _, ok := sigs[name]; !ok {
+				sigs[name] = "" // not flushed yet
+			}
+		}
+		meta.Unlock()
+		for name, sig := range sigs {
+			c := kids[name]
+			if c == nil {
+				c = getDNode(sig)
+			}
+			if c == nil {
+				continue
+			}
+			if _, ok := placeOf[c.Attrs.Inode]; ok {
+				continue // another link to it
+			}
+			placeOf[c.Attrs.Inode] = place{d.Attrs.Inode, name}
+			if c.Attrs.Mode.IsDir() {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+}
+
+// Node ino, loaded (with every directory above it) if it's stored but
+// wasn't yet; nil if we've no such node. Only what's stored here is
+// looked at, nothing is fetched. Called holding the tree exclusively.
+func storedNode(ino uint64) *DNode {
+	rebuilt := false
+	return findStored(ino, &rebuilt)
+}
+
+func findStored(ino uint64, rebuilt *bool) *DNode {
+	meta.Lock()
+	n, ok := nodeMap[ino]
+	meta.Unlock()
+	if ok {
+		return n // nil if it's been removed
+	}
+	// walking once is enough, but finding a directory above may be what
+	// walked, after we'd looked ino up
+	for try := 0; try < 3; try++ {
+		if placeOf == nil {
+			buildPlaces()
+			*rebuilt = true
+		}
+		p, ok := placeOf[ino]
+		if !ok {
+			return nil
+		}
+		if d := findStored(p.dir, rebuilt); d != nil && d.Attrs.Mode.IsDir() && d.hasLocal(p.name) {
+			if c := d.loadChild(p.name); c != nil && c.Attrs.Inode == ino {
+				return c
+			}
+		}
+		if !*rebuilt {
+			placeOf = nil // it's moved since
+		}
+	}
 	return nil
 }
 
+// Whether loading child name of n needs nothing from elsewhere.
+func (n *DNode) hasLocal(name string) bool {
+	meta.Lock()
+	_, loaded := n.kids[name]
+	sig, ok := n.childSig(name)
+	meta.Unlock()
+	return loaded || (ok && db.Has(sig))
+}
+
 func NewServerConn(ip string, port int) *serverConn {
 	return &serverConn{port: port, Addr: ip + fmt.Sprintf(":%d", port)}
 }
 
-func (s *serverConn) Call(str string, args interface{}, reply interface{}) {
-	i := 0
-	for {
-		for s.conn == nil {
-			s.conn, _ = rpc.Dial("tcp", s.Addr)
-			if i > 50 {
-				return
-			}
-			i++
+// Dials the replica unless we're connected, or it was unreachable within
+// DOWNTIME. One attempt, made without s.mu so other calls aren't held up;
+// if it fails the replica is skipped for DOWNTIME.
+func (s *serverConn) connect() error {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if time.Now().Before(s.down) {
+		s.mu.Unlock()
+		return fmt.Errorf("%s is down", s.Addr)
+	}
+	s.mu.Unlock()
+
+	c, err := net.DialTimeout("tcp", s.Addr, DIALTIMEOUT)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.down = time.Now().Add(DOWNTIME)
+		return fmt.Errorf("can't reach %s", s.Addr)
+	}
+	if s.conn != nil { // someone else got there first
+		c.Close()
+		return nil
+	}
+	s.conn = rpc.NewClient(c)
+	return nil
+}
+
+// Makes the call, dialing first if need be. A connection that's gone bad
+// (the replica restarted) is redialed once. Not for use with the tree
+// lock held, see callUp.
+func (s *serverConn) Call(str string, args interface{}, reply interface{}) error {
+	var err error
+	for i := 0; i < 2; i++ {
+		if err = s.connect(); err != nil {
+			return err
+		}
+		if err = s.call(str, args, reply); err == nil {
+			return nil
 		}
+		if _, ok := err.(rpc.ServerError); ok {
+			return err
+		}
+	}
+	return err
+}
+
+// As Call, but never waits on a dial: if we're not connected it fails at
+// once, and dials in the background for next time. For the FUSE side,
+// which holds the tree lock while it fetches.
+func (s *serverConn) callUp(str string, args interface{}, reply interface{}) error {
+	s.mu.Lock()
+	up := s.conn != nil
+	if !up && !s.dialing && !time.Now().Before(s.down) {
+		s.dialing = true
+		go func() {
+			s.connect()
+			s.mu.Lock()
+			s.dialing = false
+			s.mu.Unlock()
+		}()
+	}
+	s.mu.Unlock()
+	if !up {
+		return fmt.Errorf("not connected to %s", s.Addr)
+	}
+	return s.call(str, args, reply)
+}
 
-		if err := s.conn.Call(str, args, reply); err == nil {
-			return
+// One call on the current connection, dropping it if it's broken.
+func (s *serverConn) call(str string, args interface{}, reply interface{}) error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("not connected to %s", s.Addr)
+	}
+	err := conn.Call(str, args, reply)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
 		}
-		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
 	}
+	return err
 }
 
 //=====================================================================
@@ -263,7 +574,15 @@ func LoadConfig(rstr, fname string) {
 
 		var lname, lpid, lmount, ldb, laddr, lport, laddr2, lport2 string
 
-		flds := strings.Split(ln, ",")
+		var flds []string
+		opts := make(map[string]string)
+		for _, f := range strings.Split(ln, ",") {
+			if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+				opts[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			} else {
+				flds = append(flds, f)
+			}
+		}
 		if !contains(rnames, flds[0]) && flds[0] != myname {
 			continue
 		}
@@ -285,6 +604,7 @@ func LoadConfig(rstr, fname string) {
 			Mount: lmount,
 			Db:    ldb,
 			Addr:  laddr,
+			Opts:  opts,
 		}
 		rep.Pid, _ = strconv.Atoi(lpid)
 		rep.Port, _ = strconv.Atoi(lport)
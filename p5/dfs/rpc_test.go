@@ -0,0 +1,65 @@
+package dfs
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+type echoPeer struct{}
+
+func (echoPeer) Echo(arg *string, reply *string) error {
+	*reply = *arg
+	return nil
+}
+
+func TestCallDials(t *testing.T) {
+	srv := rpc.NewServer()
+	srv.RegisterName("Echo", echoPeer{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(l)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	arg, reply := "hi", ""
+	up := &serverConn{Addr: l.Addr().String()}
+	if err := up.callUp("Echo.Echo", &arg, &reply); err == nil {
+		t.Fatal("callUp waited for a dial")
+	}
+	for i := 0; up.callUp("Echo.Echo", &arg, &reply) != nil; i++ {
+		if i > 100 {
+			t.Fatal("background dial never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply != "hi" {
+		t.Fatal("reply", reply)
+	}
+
+	down := &serverConn{Addr: deadAddr}
+	start := time.Now()
+	if err := down.Call("Echo.Echo", &arg, &reply); err == nil {
+		t.Fatal("reached a closed port")
+	}
+	if err := down.Call("Echo.Echo", &arg, &reply); err == nil {
+		t.Fatal("reached a closed port")
+	}
+	if d := time.Since(start); d > DIALTIMEOUT {
+		t.Fatal("dialed a down replica again, took", d)
+	}
+	if err := down.callUp("Echo.Echo", &arg, &reply); err == nil {
+		t.Fatal("callUp reached a closed port")
+	}
+	down.mu.Lock()
+	dialing := down.dialing
+	down.mu.Unlock()
+	if dialing {
+		t.Fatal("redialing within DOWNTIME")
+	}
+}
@@ -0,0 +1,437 @@
+package dfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Config describes any S3-compatible endpoint (AWS, MinIO, a test
+// server). Requests are path-style: <Endpoint>/<Bucket>/<Prefix><key>.
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// s3 settings come from the environment, overridden by per-replica
+// options in config.txt (s3=<endpoint>, bucket=, region=, prefix=).
+// Returns nil if no endpoint is configured.
+func s3Config(opts map[string]string) *S3Config {
+	cfg := &S3Config{
+		Endpoint:  os.Getenv("DFS_S3_ENDPOINT"),
+		Bucket:    os.Getenv("DFS_S3_BUCKET"),
+		Region:    os.Getenv("DFS_S3_REGION"),
+		Prefix:    os.Getenv("DFS_S3_PREFIX"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	for k, p := range map[string]*string{"s3": &cfg.Endpoint, "bucket": &cfg.Bucket,
+		"region": &cfg.Region, "prefix": &cfg.Prefix,
+		"access_key": &cfg.AccessKey, "secret_key": &cfg.SecretKey} {
+		if v, ok := opts[k]; ok {
+			*p = v
+		}
+	}
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	if cfg.Bucket == "" {
+		cfg.Bucket = "dfs"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	return cfg
+}
+
+//=============================================================================
+// Minimal S3 client, signature v4.
+
+type s3Store struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+func NewS3Store(cfg S3Config) BlockStore {
+	return &s3Store{cfg, &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *s3Store) Put(key string, data []byte) error {
+	_, err := s.do("PUT", s.cfg.Prefix+key, nil, data)
+	return err
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	return s.do("GET", s.cfg.Prefix+key, nil, nil)
+}
+
+func (s *s3Store) Has(key string) bool {
+	_, err := s.do("HEAD", s.cfg.Prefix+key, nil, nil)
+	return err == nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.do("DELETE", s.cfg.Prefix+key, nil, nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		Size int
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Fetches each object as it gets to it; use Keys if the data isn't needed.
+func (s *s3Store) Iterate(prefix string, fn func(key string, data []byte) bool) error {
+	var err error
+	lerr := s.Keys(prefix, func(key string, size int) bool {
+		var data []byte
+		if data, err = s.Get(key); err != nil {
+			return false
+		}
+		return fn(key, data)
+	})
+	if err != nil {
+		return err
+	}
+	return lerr
+}
+
+// Only lists the bucket.
+func (s *s3Store) Keys(prefix string, fn func(key string, size int) bool) error {
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		body, err := s.do("GET", "", q, nil)
+		if err != nil {
+			return err
+		}
+		var res s3ListResult
+		if err := xml.Unmarshal(body, &res); err != nil {
+			return err
+		}
+		for _, c := range res.Contents {
+			if !fn(strings.TrimPrefix(c.Key, s.cfg.Prefix), c.Size) {
+				return nil
+			}
+		}
+		if !res.IsTruncated {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3Store) Close() error {
+	return nil
+}
+
+func (s *s3Store) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	path := "/" + s.cfg.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	rawQuery := canonicalQuery(query)
+	u := s.cfg.Endpoint + s3Escape(path)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, rawQuery, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("s3 %s %q: %s: %s", method, key, resp.Status, data)
+	}
+	return data, nil
+}
+
+func (s *s3Store) sign(req *http.Request, path, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(path),
+		rawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payload + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signed,
+		payload,
+	}, "\n")
+
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), day)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signed, sig))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// URI-encode per the sigv4 rules: everything but unreserved characters
+// and '/'. Our keys are base64, so '+' and '=' must be escaped.
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, strings.Replace(s3Escape(k), "/", "%2F", -1)+"="+
+				strings.Replace(s3Escape(v), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+//=============================================================================
+// Write-back cache: a local store in front of S3. Puts land locally and
+// are pushed by a background goroutine; a "s3dirty:<key>" marker in the
+// local store survives restarts until the push succeeds. Gets that miss
+// locally are fetched from S3 and cached.
+
+const S3DIRTY = "s3dirty:"
+
+type cachedStore struct {
+	local  BlockStore
+	remote BlockStore
+
+	mu      sync.Mutex
+	pending map[string]int // key -> times put since last push
+	kick    chan bool
+	done    chan bool
+	stopped chan bool // closed when writeBack returns
+}
+
+func newCachedStore(local, remote BlockStore) *cachedStore {
+	c := &cachedStore{
+		local:   local,
+		remote:  remote,
+		pending: make(map[string]int),
+		kick:    make(chan bool, 1),
+		done:    make(chan bool),
+		stopped: make(chan bool),
+	}
+	// pick up pushes that were outstanding at the last shutdown
+	local.Iterate(S3DIRTY, func(key string, data []byte) bool {
+		c.pending[strings.TrimPrefix(key, S3DIRTY)] = 1
+		return true
+	})
+	go c.writeBack()
+	return c
+}
+
+func (c *cachedStore) Put(key string, data []byte) error {
+	if err := c.local.Put(key, data); err != nil {
+		return err
+	}
+	c.local.Put(S3DIRTY+key, nil)
+	c.mu.Lock()
+	c.pending[key]++
+	c.mu.Unlock()
+	select {
+	case c.kick <- true:
+	default:
+	}
+	return nil
+}
+
+func (c *cachedStore) Get(key string) ([]byte, error) {
+	if val, err := c.local.Get(key); err == nil {
+		return val, nil
+	}
+	val, err := c.remote.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	c.local.Put(key, val)
+	return val, nil
+}
+
+func (c *cachedStore) Has(key string) bool {
+	return c.local.Has(key) || c.remote.Has(key)
+}
+
+func (c *cachedStore) Delete(key string) error {
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.mu.Unlock()
+	c.local.Delete(S3DIRTY + key)
+	if err := c.local.Delete(key); err != nil {
+		return err
+	}
+	return c.remote.Delete(key)
+}
+
+// Visits every local key, then whatever exists only in S3; only those
+// are downloaded.
+func (c *cachedStore) Iterate(prefix string, fn func(key string, data []byte) bool) error {
+	stopped := false
+	err := c.local.Iterate(prefix, func(key string, data []byte) bool {
+		if strings.HasPrefix(key, S3DIRTY) {
+			return true
+		}
+		stopped = !fn(key, data)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	lerr := c.remote.Keys(prefix, func(key string, size int) bool {
+		if c.local.Has(key) {
+			return true
+		}
+		var data []byte
+		if data, err = c.remote.Get(key); err != nil {
+			return false
+		}
+		return fn(key, data)
+	})
+	if err != nil {
+		return err
+	}
+	return lerr
+}
+
+func (c *cachedStore) Keys(prefix string, fn func(key string, size int) bool) error {
+	stopped := false
+	err := c.local.Keys(prefix, func(key string, size int) bool {
+		if strings.HasPrefix(key, S3DIRTY) {
+			return true
+		}
+		stopped = !fn(key, size)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	return c.remote.Keys(prefix, func(key string, size int) bool {
+		return c.local.Has(key) || fn(key, size)
+	})
+}
+
+// The last push runs once writeBack is out of the way.
+func (c *cachedStore) Close() error {
+	close(c.done)
+	<-c.stopped
+	c.push()
+	return c.local.Close()
+}
+
+func (c *cachedStore) writeBack() {
+	defer close(c.stopped)
+	for {
+		select {
+		case <-c.kick:
+		case <-time.After(time.Duration(FlusherPeriod) * time.Second):
+		case <-c.done:
+			return
+		}
+		c.push()
+	}
+}
+
+// push every pending key; failures stay pending for the next round, as
+// do keys (e.g. "head") rewritten while their push was in flight.
+func (c *cachedStore) push() {
+	c.mu.Lock()
+	snap := make(map[string]int, len(c.pending))
+	for k, n := range c.pending {
+		snap[k] = n
+	}
+	c.mu.Unlock()
+
+	for k, n := range snap {
+		data, err := c.local.Get(k)
+		if err == nil {
+			err = c.remote.Put(k, data)
+		}
+		if err != nil && err != ErrNotFound {
+			p_err("s3 push %q: %v\n", k, err)
+			continue
+		}
+		c.mu.Lock()
+		if c.pending[k] == n {
+			delete(c.pending, k)
+			c.local.Delete(S3DIRTY + k)
+		}
+		c.mu.Unlock()
+	}
+}
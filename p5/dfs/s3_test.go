@@ -0,0 +1,309 @@
+package dfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An S3 stand-in: one bucket, path-style, that checks every request's
+// signature the way the service would, from what arrived.
+type fakeS3 struct {
+	t      *testing.T
+	secret string
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    int // object bodies served
+	fail    bool
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, secret: "secret", bucket: "dfs", objects: make(map[string][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+var authRE = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([^,]+), Signature=([0-9a-f]{64})$`)
+
+func (f *fakeS3) checkSig(r *http.Request, body []byte) error {
+	m := authRE.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return fmt.Errorf("bad Authorization %q", r.Header.Get("Authorization"))
+	}
+	day, region, signed, sig := m[2], m[3], m[4], m[5]
+	amzDate := r.Header.Get("x-amz-date")
+	if !strings.HasPrefix(amzDate, day) {
+		return fmt.Errorf("x-amz-date %q not on %s", amzDate, day)
+	}
+	h := sha256.Sum256(body)
+	if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(h[:]) {
+		return fmt.Errorf("payload hash doesn't match the body")
+	}
+	var hdrs string
+	for _, name := range strings.Split(signed, ";") {
+		v := r.Header.Get(name)
+		if name == "host" {
+			v = r.Host
+		}
+		hdrs += name + ":" + v + "\n"
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery,
+		hdrs, signed, r.Header.Get("x-amz-content-sha256")}, "\n")
+	ch := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + day + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(ch[:])
+	key := []byte("AWS4" + f.secret)
+	for _, s := range []string{day, region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		key = mac.Sum(nil)
+	}
+	if hex.EncodeToString(key) != sig {
+		return fmt.Errorf("signature mismatch for %s %s", r.Method, r.URL)
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := f.checkSig(r, body); err != nil {
+		f.t.Error(err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	if path == "" && r.Method == "GET" {
+		f.list(w, r)
+		return
+	}
+	key := strings.TrimPrefix(path, "/")
+	switch r.Method {
+	case "PUT":
+		f.objects[key] = body
+	case "GET", "HEAD":
+		val, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			f.gets++
+			w.Write(val)
+		}
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// two keys a page, to exercise continuation
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		f.t.Errorf("list-type %q", q.Get("list-type"))
+	}
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var res s3ListResult
+	if len(keys) > 2 {
+		keys = keys[:2]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[1]
+	}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, struct {
+			Key  string
+			Size int
+		}{k, len(f.objects[k])})
+	}
+	out, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: res})
+	w.Write(out)
+}
+
+func (f *fakeS3) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.objects[key]
+	return ok
+}
+
+func testS3Store(srv *httptest.Server) BlockStore {
+	return NewS3Store(S3Config{Endpoint: srv.URL, Bucket: "dfs", Region: "us-east-1",
+		Prefix: "p/", AccessKey: "AKID", SecretKey: "secret"})
+}
+
+func TestS3Store(t *testing.T) {
+	_, srv := newFakeS3(t)
+	storeContract(t, testS3Store(srv))
+}
+
+func TestS3KeysSkipBodies(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := testS3Store(srv)
+	// base64 keys need escaping, in the path and in the signature
+	keys := []string{"a+b/c=", "head", "x/y+z=="}
+	for _, k := range keys {
+		s.Put(k, []byte("data"))
+	}
+	f.mu.Lock()
+	if _, ok := f.objects["p/a+b/c="]; !ok {
+		t.Errorf("stored as %v", f.objects)
+	}
+	f.mu.Unlock()
+	var got []string
+	s.Keys("", func(k string, size int) bool {
+		if size != 4 {
+			t.Errorf("%s: size %d", k, size)
+		}
+		got = append(got, k)
+		return true
+	})
+	if strings.Join(got, " ") != strings.Join(keys, " ") || f.gets != 0 {
+		t.Fatalf("Keys: %v, %d bodies fetched", got, f.gets)
+	}
+}
+
+func TestCachedStoreWriteBack(t *testing.T) {
+	f, srv := newFakeS3(t)
+	local := NewMemStore()
+	c := newCachedStore(local, testS3Store(srv))
+	c.Put("k1", []byte("one"))
+	if !local.Has(S3DIRTY + "k1") {
+		t.Fatal("no dirty marker")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for local.Has(S3DIRTY+"k1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if local.Has(S3DIRTY+"k1") || !f.has("p/k1") {
+		t.Fatal("not pushed")
+	}
+
+	// a push that fails stays marked
+	f.mu.Lock()
+	f.fail = true
+	f.mu.Unlock()
+	c.Put("k2", []byte("two"))
+	c.push()
+	if !local.Has(S3DIRTY+"k2") || f.has("p/k2") {
+		t.Fatal("failed push dropped its marker")
+	}
+	close(c.done)
+
+	// and is picked up after a restart
+	f.mu.Lock()
+	f.fail = false
+	f.mu.Unlock()
+	c = newCachedStore(local, testS3Store(srv))
+	c.push()
+	if local.Has(S3DIRTY+"k2") || !f.has("p/k2") {
+		t.Fatal("pending push lost over a restart")
+	}
+
+	// misses come from S3 and are cached; Iterate downloads only those
+	f.mu.Lock()
+	f.objects["p/k3"] = []byte("three")
+	f.gets = 0
+	f.mu.Unlock()
+	var keys []string
+	c.Iterate("", func(k string, data []byte) bool {
+		keys = append(keys, k+"="+string(data))
+		return true
+	})
+	if strings.Join(keys, " ") != "k1=one k2=two k3=three" || f.gets != 1 {
+		t.Fatalf("Iterate: %v, %d bodies fetched", keys, f.gets)
+	}
+	if val, err := c.Get("k3"); err != nil || string(val) != "three" || !local.Has("k3") {
+		t.Fatalf("Get k3: %q %v", val, err)
+	}
+	c.Delete("k1")
+	if f.has("p/k1") || local.Has("k1") {
+		t.Fatal("Delete")
+	}
+	c.Close()
+}
+
+func TestS3ConfigCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "envkey")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	cfg := s3Config(map[string]string{"s3": "http://s3/"})
+	if cfg.AccessKey != "envkey" || cfg.SecretKey != "envsecret" || cfg.Endpoint != "http://s3" {
+		t.Fatalf("env fallback: %+v", cfg)
+	}
+	cfg = s3Config(map[string]string{"s3": "http://s3", "access_key": "AKID", "secret_key": "secret"})
+	if cfg.AccessKey != "AKID" || cfg.SecretKey != "secret" {
+		t.Fatalf("opts: %+v", cfg)
+	}
+}
+
+func TestCachedStoreClose(t *testing.T) {
+	f, srv := newFakeS3(t)
+	local := NewMemStore()
+	c := newCachedStore(local, testS3Store(srv))
+	for i := 0; i < 20; i++ {
+		c.Put(fmt.Sprint("k", i), []byte("v"))
+	}
+	c.Close()
+	select {
+	case <-c.stopped:
+	default:
+		t.Fatal("writeBack still running after Close")
+	}
+	for i := 0; i < 20; i++ {
+		if k := fmt.Sprint("k", i); !f.has("p/"+k) || local.Has(S3DIRTY+k) {
+			t.Fatalf("%s not pushed by Close", k)
+		}
+	}
+}
+
+func TestStatsLocalOnly(t *testing.T) {
+	f, srv := newFakeS3(t)
+	testFS(t)
+	c := newCachedStore(NewMemStore(), testS3Store(srv))
+	t.Cleanup(func() { c.Close() })
+	db = c
+	block := []byte("held locally")
+	c.Put(shaString(block), block)
+	f.mu.Lock()
+	f.objects["p/"+shaString([]byte("only in S3"))] = []byte("only in S3")
+	f.gets = 0
+	f.mu.Unlock()
+
+	out, err := cmdStats(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	gets := f.gets
+	f.mu.Unlock()
+	if gets != 0 || !strings.Contains(out, "store: 1 blocks") {
+		t.Fatalf("%d bodies fetched:\n%s", gets, out)
+	}
+}
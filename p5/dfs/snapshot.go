@@ -0,0 +1,179 @@
+package dfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//=============================================================================
+// Named snapshots.
+//
+// A snapshot pins one root under SNAPKEY+name. Pinned roots are gc roots,
+// are always kept by prune, and show up by name in the root's .snapshots
+// (or can be mounted on their own, read-only, with "-S name").
+//
+// SNAPKEY has a ':' so a snapshot key can never look like a block sig.
+
+const SNAPKEY = "snap:"
+
+type Snapshot struct {
+	Name    string
+	Root    string
+	Version uint64
+	Created time.Time
+}
+
+var snapshots = make(map[string]*Snapshot)
+var snapGen uint64     // bumped whenever snapshots changes
+var MountSnapshot = "" // mount this snapshot instead of the head
+
+func validSnapName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/@") {
+		return fmt.Errorf("bad snapshot name %q", name)
+	}
+	return nil
+}
+
+func loadSnapshots() {
+	snapshots = make(map[string]*Snapshot)
+	err := db.Iterate(SNAPKEY, func(key string, val []byte) bool {
+		s := new(Snapshot)
+		if err := json.Unmarshal(val, s); err != nil {
+			p_err("snapshot %q: %v\n", key, err)
+			return true
+		}
+		snapshots[s.Name] = s
+		return true
+	})
+	if err != nil {
+		p_err("loading snapshots: %v\n", err)
+	}
+	snapGen++
+}
+
+// Oldest first.
+func snapshotList() (l []*Snapshot) {
+	for _, s := range snapshots {
+		l = append(l, s)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Created.Before(l[j].Created) })
+	return
+}
+
+func putSnapshot(s *Snapshot) error {
+	if err := putBlockSig(SNAPKEY+s.Name, Marshal(s)); err != nil {
+		return err
+	}
+	snapshots[s.Name] = s
+	snapGen++
+	return nil
+}
+
+// Pins the current root as name. Must be called with the lock held, or
+// on an unmounted store.
+func createSnapshot(name string) (*Snapshot, error) {
+	if err := validSnapName(name); err != nil {
+		return nil, err
+	}
+	if _, ok := snapshots[name]; ok {
+		return nil, fmt.Errorf("snapshot %q exists", name)
+	}
+	if root != nil && root.metaDirty {
+		flushRoot()
+	}
+	if head.Root == "" {
+		return nil, fmt.Errorf("nothing flushed yet")
+	}
+	rn := getDNode(head.Root)
+	if rn == nil {
+		return nil, fmt.Errorf("root %s not in store", head.Root)
+	}
+	s := &Snapshot{Name: name, Root: head.Root, Version: rn.Version, Created: time.Now()}
+	return s, putSnapshot(s)
+}
+
+func deleteSnapshot(name string) error {
+	if _, ok := snapshots[name]; !ok {
+		return fmt.Errorf("no snapshot %q", name)
+	}
+	if err := db.Delete(SNAPKEY + name); err != nil {
+		return err
+	}
+	delete(snapshots, name)
+	snapGen++
+	return nil
+}
+
+// Pinned root sigs, and the snapshots pinning each.
+func pinnedRoots() map[string][]*Snapshot {
+	m := make(map[string][]*Snapshot)
+	for _, s := range snapshots {
+		m[s.Root] = append(m[s.Root], s)
+	}
+	return m
+}
+
+// Called by prune when it rewrites a pinned root, so the pin follows
+// the chain rather than holding the old copy alive.
+func repinSnapshots(pinned []*Snapshot, sig string) {
+	for _, s := range pinned {
+		s.Root = sig
+		if err := putSnapshot(s); err != nil {
+			p_err("snapshot %q: %v\n", s.Name, err)
+		}
+	}
+}
+
+// Root for "-S name": the snapshot, read-only.
+func snapshotRoot(name string) *DNode {
+	s, ok := snapshots[name]
+	p_dieif(!ok, "no snapshot %q\n", name)
+	n := getDNode(s.Root)
+	p_dieif(n == nil, "snapshot %q: root %s not in store\n", name, s.Root)
+	n.sig = s.Root
+	n.archive = true
+	return n
+}
+
+// "snapshot [list] | snapshot create|delete <name>"
+func cmdSnapshot(args []string) (string, error) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	usage := fmt.Errorf("usage: %s", commands["snapshot"].usage)
+	var buf bytes.Buffer
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return "", usage
+		}
+		for _, s := range snapshotList() {
+			fmt.Fprintf(&buf, "%-20s %s  v%d  %s\n", s.Name,
+				s.Created.Format("2006-01-02 15:04:05"), s.Version, s.Root)
+		}
+	case "create":
+		if len(args) != 2 {
+			return "", usage
+		}
+		s, err := createSnapshot(args[1])
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, "snapshot %s: v%d %s\n", s.Name, s.Version, s.Root)
+	case "delete":
+		if len(args) != 2 {
+			return "", usage
+		}
+		if err := deleteSnapshot(args[1]); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, "deleted snapshot %s (run gc to free its blocks)\n", args[1])
+	default:
+		return "", usage
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,58 @@
+package dfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// A snapshot's root is kept through prune and gc, and reads back as it
+// was, before and after a restart.
+func TestSnapshotSurvivesGC(t *testing.T) {
+	f := newSparseFile(t)
+	t.Cleanup(func() { snapshots = make(map[string]*Snapshot) })
+	v1 := noise(1, 5000)
+	f.write(0, v1)
+	f.flush()
+	flushRoot()
+	if _, err := createSnapshot("keep"); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(2); i < 4; i++ {
+		f.write(0, noise(i, 5000))
+		f.flush()
+		flushRoot()
+	}
+
+	r, _ := ParseRetention("1")
+	if dropped := r.prune(time.Now(), false); dropped == 0 {
+		t.Fatal("nothing pruned")
+	}
+	res, err := gc(true, false)
+	if err != nil || res.Deleted == 0 {
+		t.Fatal("gc", res, err)
+	}
+	for i := 0; i < 2; i++ {
+		snap := lookup(t, lookup(t, root, SNAPDIR), "keep")
+		if got := contents(t, lookup(t, snap, "f")); !bytes.Equal(got, v1) {
+			t.Fatalf("snapshot's f has %d bytes, not v1", len(got))
+		}
+		if got := contents(t, lookup(t, root, "f")); !bytes.Equal(got, f.want) {
+			t.Fatalf("f has %d bytes, not the current version", len(got))
+		}
+		restart()
+	}
+
+	// looked up, never listed
+	ents, err := root.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range ents {
+		if e.Name == SNAPDIR {
+			t.Fatal(SNAPDIR, "listed")
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package dfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+//=============================================================================
+// Sparse files.
+//
+// A file is a list of extents: DataBlocks[i] is the sig of a chunk, or ""
+// for a hole of BlockLens[i] zero bytes, which stores nothing. An extent
+// may be shorter than its chunk (after a truncate), and is then the
+// chunk's first BlockLens[i] bytes. Runs of HOLEMIN or more zeros become
+// holes when data is chunked, and growing a file, with truncate or by
+// writing past the end, adds one.
+//
+// Only what's being written is in memory: windows, each covering whole
+// extents (holes are split to fit), which Flush chunks back into extents.
+// The extents always add up to Size.
+//
+// The kernel side of fallocate(2) and SEEK_HOLE/SEEK_DATA isn't passed on
+// by the fuse package we use, so punching holes and finding them are
+// commands ("punch", "holes").
+
+const (
+	HOLEMIN   = 4096 // zero runs at least this long are stored as holes
+	HOLEALIGN = 4096 // holes are split at multiples of this
+)
+
+// Bytes [off, off+len(data)) of a file being written.
+type window struct {
+	off    uint64
+	data   []byte
+	lo, hi uint64 // changed range; none if lo >= hi
+}
+
+func (w *window) end() uint64 {
+	return w.off + uint64(len(w.data))
+}
+
+func (w *window) mark(lo, hi uint64) {
+	if w.lo >= w.hi {
+		w.lo, w.hi = lo, hi
+		return
+	}
+	if lo < w.lo {
+		w.lo = lo
+	}
+	if hi > w.hi {
+		w.hi = hi
+	}
+}
+
+// Length of the run of zeros at the start of b.
+func zeroRun(b []byte) int {
+	z := 0
+	for z < len(b) && b[z] == 0 {
+		z++
+	}
+	return z
+}
+
+// The next extent of b: a hole for a long enough run of zeros, otherwise
+// a chunk.
+func nextExtent(b []byte) (hole bool, l int) {
+	if z := zeroRun(b); z >= HOLEMIN {
+		return true, z
+	}
+	return false, chunker.Next(b)
+}
+
+// Appends an extent, merging holes.
+func addExtent(sigs []string, lens []uint64, sig string, l uint64) ([]string, []uint64) {
+	if k := len(sigs) - 1; sig == "" && k >= 0 && sigs[k] == "" {
+		lens[k] += l
+		return sigs, lens
+	}
+	return append(sigs, sig), append(lens, l)
+}
+
+// Whether the extents' offsets are worked out; Read needs the inode lock
+// exclusively to do it.
+func (n *DNode) layoutReady() bool {
+	return len(n.BlockLens) == len(n.DataBlocks) && len(n.extOff) == len(n.DataBlocks)+1
+}
+
+// The start of each extent, and the end of the last. Caller holds n's
+// inode lock, exclusively unless layoutReady().
+func (n *DNode) extentStarts() []uint64 {
+	if n.layoutReady() {
+		return n.extOff
+	}
+	lens := n.blockLens()
+	offs := make([]uint64, len(lens)+1)
+	for i, l := range lens {
+		offs[i+1] = offs[i] + l
+	}
+	n.extOff = offs
+	return offs
+}
+
+// Works out the extents' offsets, failing if a chunk needed for that
+// can't be fetched. Caller holds n's inode lock exclusively.
+func (n *DNode) loadLayout() error {
+	n.extentStarts()
+	if !n.layoutReady() {
+		p_err("%q: chunk lengths unknown, blocks missing\n", n.Name)
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Index and start of the extent holding off; len(DataBlocks) and the end
+// of the extents if it's past them.
+func (n *DNode) extentAt(off uint64) (int, uint64) {
+	offs := n.extentStarts()
+	i := sort.Search(len(offs)-1, func(i int) bool { return offs[i+1] > off })
+	return i, offs[i]
+}
+
+func (n *DNode) setExtents(sigs []string, lens []uint64) {
+	n.DataBlocks, n.BlockLens = sigs, lens
+	n.extOff = nil
+}
+
+// Splits hole i at off, if off is inside it.
+func (n *DNode) splitHole(i int, off uint64) {
+	offs := n.extentStarts()
+	if i >= len(n.DataBlocks) || n.DataBlocks[i] != "" || off <= offs[i] || off >= offs[i+1] {
+		return
+	}
+	sigs := append(append(append([]string(nil), n.DataBlocks[:i+1]...), ""), n.DataBlocks[i+1:]...)
+	lens := append(append(append([]uint64(nil), n.BlockLens[:i]...), off-offs[i], offs[i+1]-off), n.BlockLens[i+1:]...)
+	n.setExtents(sigs, lens)
+}
+
+// The window holding off, or nil.
+func (n *DNode) inWindow(off uint64) *window {
+	for _, w := range n.wins {
+		if off >= w.off && off < w.end() {
+			return w
+		}
+	}
+	return nil
+}
+
+// Copies the part of src, which is at file offset soff, that falls in dst,
+// at doff.
+func copyAt(dst []byte, doff uint64, src []byte, soff uint64) {
+	if soff < doff {
+		if doff-soff >= uint64(len(src)) {
+			return
+		}
+		src, soff = src[doff-soff:], doff
+	}
+	if soff-doff < uint64(len(dst)) {
+		copy(dst[soff-doff:], src)
+	}
+}
+
+// Bytes [off, end) of the file, from the windows and the extents. Caller
+// holds n's inode lock, exclusively unless layoutReady().
+func (n *DNode) readRange(off, end uint64) ([]byte, error) {
+	buf := make([]byte, end-off)
+	offs := n.extentStarts()
+	var want []int
+	for i, _ := n.extentAt(off); i < len(n.DataBlocks) && offs[i] < end; i++ {
+		if n.DataBlocks[i] != "" && n.inWindow(offs[i]) == nil {
+			want = append(want, i)
+		}
+	}
+	for j, blk := range n.fetchBlocks(want) {
+		i := want[j]
+		if blk == nil {
+			p_err("Read: block %s of %q missing\n", n.DataBlocks[i], n.Name)
+			return nil, fuse.EIO
+		}
+		if l := n.BlockLens[i]; uint64(len(blk)) > l {
+			blk = blk[:l]
+		}
+		copyAt(buf, off, blk, offs[i])
+	}
+	for _, w := range n.wins {
+		copyAt(buf, off, w.data, w.off)
+	}
+	return buf, nil
+}
+
+// Makes the extents add up to Size, which they may not in files flushed
+// mid-write by older versions.
+func (n *DNode) fitExtents() {
+	offs := n.extentStarts()
+	if l := offs[len(offs)-1]; l < n.Attrs.Size {
+		n.growExtents(n.Attrs.Size - l)
+	} else if l > n.Attrs.Size {
+		n.cutExtents(n.Attrs.Size)
+	}
+}
+
+// Adds a hole of l bytes at the end.
+func (n *DNode) growExtents(l uint64) {
+	offs := n.extentStarts()
+	k := len(n.DataBlocks) - 1
+	if k >= 0 && n.DataBlocks[k] == "" && n.inWindow(offs[k]) == nil {
+		lens := append([]uint64(nil), n.BlockLens...)
+		lens[k] += l
+		n.setExtents(n.DataBlocks, lens)
+		return
+	}
+	n.setExtents(append(n.DataBlocks[:k+1:k+1], ""), append(n.BlockLens[:k+1:k+1], l))
+}
+
+// Drops everything from size on. An extent ending past size is cut short.
+func (n *DNode) cutExtents(size uint64) {
+	var wins []*window
+	for _, w := range n.wins {
+		if w.off >= size {
+			continue
+		}
+		if w.end() > size {
+			w.data = w.data[:size-w.off]
+			if w.hi > size {
+				w.hi = size
+			}
+		}
+		wins = append(wins, w)
+	}
+	n.wins = wins
+
+	i, start := n.extentAt(size)
+	if i == len(n.DataBlocks) {
+		return
+	}
+	if start == size {
+		n.setExtents(n.DataBlocks[:i:i], n.BlockLens[:i:i])
+		return
+	}
+	lens := append([]uint64(nil), n.BlockLens[:i+1]...)
+	lens[i] = size - start
+	n.setExtents(n.DataBlocks[:i+1:i+1], lens)
+}
+
+// Bytes of n held in windows. Caller holds n's inode lock.
+func (n *DNode) windowed() (l int) {
+	for _, w := range n.wins {
+		l += len(w.data)
+	}
+	return l
+}
+
+// A window over at least [lo, hi), which must be within Size, merged with
+// any it touches. Holes are split at HOLEALIGN around it, so only what's
+// needed of them is in memory.
+func (n *DNode) window(lo, hi uint64) (*window, error) {
+	i, _ := n.extentAt(lo)
+	n.splitHole(i, lo&^(HOLEALIGN-1))
+	j, _ := n.extentAt(hi - 1)
+	n.splitHole(j, (hi+HOLEALIGN-1)&^(HOLEALIGN-1))
+
+	offs := n.extentStarts()
+	_, start := n.extentAt(lo)
+	j, _ = n.extentAt(hi - 1)
+	end := offs[j+1]
+
+	var merge, keep []*window
+	for _, w := range n.wins {
+		if w.off <= end && w.end() >= start {
+			merge = append(merge, w)
+			if w.off < start {
+				start = w.off
+			}
+			if w.end() > end {
+				end = w.end()
+			}
+		} else {
+			keep = append(keep, w)
+		}
+	}
+
+	var w *window
+	if len(merge) == 1 && merge[0].off == start {
+		// usually a write just past the end of the last one
+		w = merge[0]
+		if tail := w.end(); end > tail {
+			more, err := n.readRange(tail, end)
+			if err != nil {
+				return nil, err
+			}
+			w.data = append(w.data, more...)
+		}
+	} else {
+		data, err := n.readRange(start, end)
+		if err != nil {
+			return nil, err
+		}
+		w = &window{off: start, data: data}
+		for _, m := range merge {
+			if m.lo < m.hi {
+				w.mark(m.lo, m.hi)
+			}
+		}
+	}
+	n.wins = append(keep, w)
+	sort.Slice(n.wins, func(a, b int) bool { return n.wins[a].off < n.wins[b].off })
+	return w, nil
+}
+
+// Zeroes [off, off+length), within Size: data extents wholly inside
+// become holes, the rest is zeroed in windows. Caller holds n's inode
+// lock, and flushes the data.
+func (n *DNode) punch(off, length uint64) error {
+	n.fitExtents()
+	end := off + length
+	if end > n.Attrs.Size {
+		end = n.Attrs.Size
+	}
+	if off >= end {
+		return nil
+	}
+	offs := n.extentStarts()
+	i, _ := n.extentAt(off)
+	j, _ := n.extentAt(end - 1)
+	sigs := append([]string(nil), n.DataBlocks...)
+	var partial [][2]uint64
+	for k := i; k <= j; k++ {
+		switch {
+		case sigs[k] == "" || n.inWindow(offs[k]) != nil:
+		case offs[k] >= off && offs[k+1] <= end:
+			sigs[k] = ""
+		default:
+			partial = append(partial, [2]uint64{offs[k], offs[k+1]})
+		}
+	}
+	n.setExtents(sigs, n.BlockLens)
+	for _, p := range partial {
+		if p[0] < off {
+			p[0] = off
+		}
+		if p[1] > end {
+			p[1] = end
+		}
+		if _, err := n.window(p[0], p[1]); err != nil {
+			return err
+		}
+	}
+	for _, w := range n.wins {
+		lo, hi := off, end
+		if lo < w.off {
+			lo = w.off
+		}
+		if hi > w.end() {
+			hi = w.end()
+		}
+		if lo < hi {
+			copy(w.data[lo-w.off:hi-w.off], make([]byte, hi-lo))
+			w.mark(lo, hi)
+		}
+	}
+	n.dirty = true
+	return nil
+}
+
+// Where the next data (or hole) at or after off starts, as lseek(2)'s
+// SEEK_DATA and SEEK_HOLE: windows count as data, and there's always a
+// hole at Size. false past the end, or if there's no more data. Caller
+// holds n's inode lock, exclusively unless layoutReady().
+func (n *DNode) seek(off uint64, data bool) (uint64, bool) {
+	size := n.Attrs.Size
+	if off >= size {
+		return 0, false
+	}
+	offs := n.extentStarts()
+	i, _ := n.extentAt(off)
+	for ; i < len(n.DataBlocks) && offs[i] < size; i++ {
+		if isData := n.DataBlocks[i] != "" || n.inWindow(offs[i]) != nil; isData == data {
+			if offs[i] > off {
+				return offs[i], true
+			}
+			return off, true
+		}
+	}
+	if data {
+		return 0, false
+	}
+	h := offs[i] // older files' extents may stop short of Size
+	if h > size {
+		h = size
+	}
+	if h < off {
+		h = off
+	}
+	return h, true
+}
+
+// "holes <path>": the data extents of a file, as SEEK_DATA/SEEK_HOLE
+// would find them.
+func cmdHoles(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: %s", commands["holes"].usage)
+	}
+	n, err := lookupPath(args[0])
+	if err != nil {
+		return "", err
+	}
+	n.lock()
+	if err := n.loadLayout(); err != nil {
+		n.unlock()
+		return "", err
+	}
+	var buf bytes.Buffer
+	var stored uint64
+	for off := uint64(0); ; {
+		lo, ok := n.seek(off, true)
+		if !ok {
+			break
+		}
+		hi, _ := n.seek(lo, false)
+		fmt.Fprintf(&buf, "data %12d %12d\n", lo, hi)
+		stored += hi - lo
+		off = hi
+	}
+	fmt.Fprintf(&buf, "size %d, %d in data extents\n", n.Attrs.Size, stored)
+	n.unlock()
+	return buf.String(), nil
+}
+
+// "punch <path> <offset> <length>": as fallocate -p.
+func cmdPunch(args []string) (string, error) {
+	if len(args) != 3 {
+		return "", fmt.Errorf("usage: %s", commands["punch"].usage)
+	}
+	off, err1 := strconv.ParseUint(args[1], 0, 64)
+	length, err2 := strconv.ParseUint(args[2], 0, 64)
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("usage: %s", commands["punch"].usage)
+	}
+	n, err := lookupPath(args[0])
+	if err != nil {
+		return "", err
+	}
+	meta.Lock()
+	bad := n.Attrs.Mode.IsDir() || inArchive(n)
+	meta.Unlock()
+	if bad {
+		return "", fmt.Errorf("%s: not a writable file", args[0])
+	}
+	n.lock()
+	err = n.loadLayout()
+	if err == nil {
+		err = n.punch(off, length)
+	}
+	if err != nil {
+		n.unlock()
+		return "", err
+	}
+	n.flushData()
+	meta.Lock()
+	markDirty(n)
+	meta.Unlock()
+	n.unlock()
+	flushRoot()
+	return fmt.Sprintf("punched %s [%d, %d)\n", args[0], off, off+length), nil
+}
+
+// The node at path, from the root. Commands hold the tree exclusively.
+func lookupPath(path string) (*DNode, error) {
+	n := root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		c := n.loadChild(name)
+		if c == nil {
+			return nil, fmt.Errorf("%s: no such file", path)
+		}
+		n = c
+	}
+	return n, nil
+}
@@ -0,0 +1,291 @@
+package dfs
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// A fresh file system on an in-memory store.
+func testFS(t *testing.T) {
+	db = NewMemStore()
+	Merep = &Replica{Pid: 1}
+	Clients = map[int]*serverConn{}
+	nodeMap = make(map[uint64]*DNode)
+	head = nil
+	loadRoot()
+}
+
+// A file under test, and what it should hold.
+type sparseFile struct {
+	t    *testing.T
+	n    *DNode
+	h    *Handle
+	want []byte
+}
+
+func newSparseFile(t *testing.T) *sparseFile {
+	testFS(t)
+	n, h, err := root.Create(context.Background(), &fuse.CreateRequest{Name: "f", Mode: 0644,
+		Flags: fuse.OpenReadWrite}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sparseFile{t: t, n: n.(*DNode), h: h.(*Handle)}
+}
+
+// Random bytes, without the zero runs that would become holes.
+func noise(seed int64, l int) []byte {
+	b := make([]byte, l)
+	r := rand.New(rand.NewSource(seed))
+	for i := range b {
+		b[i] = byte(r.Intn(255) + 1)
+	}
+	return b
+}
+
+func (f *sparseFile) write(off int, data []byte) {
+	err := f.h.Write(context.Background(), &fuse.WriteRequest{Offset: int64(off), Data: data}, &fuse.WriteResponse{})
+	if err != nil {
+		f.t.Fatalf("write at %d: %v", off, err)
+	}
+	if end := off + len(data); end > len(f.want) {
+		f.want = append(f.want, make([]byte, end-len(f.want))...)
+	}
+	copy(f.want[off:], data)
+}
+
+func (f *sparseFile) truncate(size int) {
+	f.n.lock()
+	err := f.n.setSize(uint64(size))
+	f.n.flushData()
+	f.n.unlock()
+	if err != nil {
+		f.t.Fatalf("truncate to %d: %v", size, err)
+	}
+	if size > len(f.want) {
+		f.want = append(f.want, make([]byte, size-len(f.want))...)
+	}
+	f.want = f.want[:size]
+}
+
+func (f *sparseFile) punch(off, length int) {
+	f.n.lock()
+	err := f.n.loadLayout()
+	if err == nil {
+		err = f.n.punch(uint64(off), uint64(length))
+	}
+	f.n.flushData()
+	f.n.unlock()
+	if err != nil {
+		f.t.Fatalf("punch [%d, +%d): %v", off, length, err)
+	}
+	for i := off; i < off+length && i < len(f.want); i++ {
+		f.want[i] = 0
+	}
+}
+
+func (f *sparseFile) flush() {
+	f.h.Flush(context.Background(), &fuse.FlushRequest{})
+}
+
+// Reads the whole file back, and checks the extents add up.
+func (f *sparseFile) check(what string) {
+	f.t.Helper()
+	resp := &fuse.ReadResponse{}
+	err := f.h.Read(context.Background(), &fuse.ReadRequest{Size: len(f.want) + 100}, resp)
+	if err != nil {
+		f.t.Fatalf("%s: read: %v", what, err)
+	}
+	if !bytes.Equal(resp.Data, f.want) {
+		f.t.Fatalf("%s: read %d bytes, want %d; first difference at %d", what,
+			len(resp.Data), len(f.want), firstDiff(resp.Data, f.want))
+	}
+	f.n.lock()
+	offs := f.n.extentStarts()
+	f.n.unlock()
+	if end := offs[len(offs)-1]; end != uint64(len(f.want)) || f.n.Attrs.Size != end {
+		f.t.Fatalf("%s: extents end at %d, size %d, want %d", what, end, f.n.Attrs.Size, len(f.want))
+	}
+	for i, l := range f.n.BlockLens {
+		if l == 0 {
+			f.t.Fatalf("%s: empty extent %d", what, i)
+		}
+	}
+}
+
+func firstDiff(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
+
+// How many of the file's bytes are in holes.
+func (f *sparseFile) holeBytes() (h uint64) {
+	for i, sig := range f.n.DataBlocks {
+		if sig == "" {
+			h += f.n.BlockLens[i]
+		}
+	}
+	return
+}
+
+func TestSparseEdits(t *testing.T) {
+	type step struct {
+		op         string // write, truncate, punch, punchExtent
+		off, l     int
+		flush      bool
+		minHoleLen uint64 // at least this much should be holes after
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"write inside a hole", []step{
+			{op: "truncate", l: 65536},
+			{op: "write", off: 20000, l: 100, flush: true, minHoleLen: 65536 - 2*HOLEALIGN},
+		}},
+		{"write straddling the start of a hole", []step{
+			{op: "write", l: 10000, flush: true},
+			{op: "truncate", l: 50000},
+			{op: "write", off: 9000, l: 3000, flush: true, minHoleLen: 30000},
+		}},
+		{"write straddling the end of a hole", []step{
+			{op: "truncate", l: 20000},
+			{op: "write", off: 20000, l: 5000, flush: true},
+			{op: "write", off: 18000, l: 3000, flush: true, minHoleLen: 12000},
+		}},
+		{"write beyond a hole", []step{
+			{op: "write", l: 5000, flush: true},
+			{op: "write", off: 100000, l: 7000, flush: true, minHoleLen: 90000},
+		}},
+		{"write covering a whole hole", []step{
+			{op: "write", l: 3000},
+			{op: "truncate", l: 40000},
+			{op: "write", off: 2000, l: 40000, flush: true},
+		}},
+		{"unflushed writes either side of a hole", []step{
+			{op: "truncate", l: 200000},
+			{op: "write", off: 1000, l: 100},
+			{op: "write", off: 150000, l: 100},
+			{op: "write", off: 1100, l: 5000, flush: true, minHoleLen: 100000},
+		}},
+		{"punch whole extents", []step{
+			{op: "write", l: 60000, flush: true},
+			{op: "punchExtent", off: 2, l: 3, minHoleLen: 1},
+		}},
+		{"punch a byte either side of extent edges", []step{
+			{op: "write", l: 60000, flush: true},
+			{op: "punchExtent", off: 3, l: -1},
+		}},
+		{"punch inside one chunk", []step{
+			{op: "write", l: 20000, flush: true},
+			{op: "punch", off: 100, l: 10},
+		}},
+		{"punch then write into it", []step{
+			{op: "write", l: 60000, flush: true},
+			{op: "punch", off: 10000, l: 30000, minHoleLen: 20000},
+			{op: "write", off: 20000, l: 50, flush: true, minHoleLen: 10000},
+		}},
+		{"punch past the end", []step{
+			{op: "write", l: 20000, flush: true},
+			{op: "punch", off: 15000, l: 100000},
+		}},
+		{"truncate into a hole", []step{
+			{op: "write", l: 5000, flush: true},
+			{op: "truncate", l: 100000},
+			{op: "write", off: 90000, l: 1000, flush: true},
+			{op: "truncate", l: 50000},
+			{op: "truncate", l: 60000, minHoleLen: 50000},
+			{op: "write", off: 59990, l: 20, flush: true},
+		}},
+		{"truncate into a chunk, then append", []step{
+			{op: "write", l: 30000, flush: true},
+			{op: "truncate", l: 12345},
+			{op: "write", off: 12345, l: 4000, flush: true},
+		}},
+		{"truncate to zero and regrow", []step{
+			{op: "write", l: 30000, flush: true},
+			{op: "truncate", l: 0},
+			{op: "truncate", l: 10000},
+			{op: "write", off: 5000, l: 10, flush: true},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newSparseFile(t)
+			for i, s := range tc.steps {
+				switch s.op {
+				case "write":
+					f.write(s.off, noise(int64(i), s.l))
+				case "truncate":
+					f.truncate(s.l)
+				case "punch":
+					f.punch(s.off, s.l)
+				case "punchExtent":
+					// extents off..off+l, or a byte either side of extent off if l < 0
+					offs := append([]uint64(nil), f.n.extentStarts()...)
+					if s.l < 0 {
+						f.punch(int(offs[s.off])-1, int(offs[s.off+1]-offs[s.off])+2)
+					} else {
+						f.punch(int(offs[s.off]), int(offs[s.off+s.l]-offs[s.off]))
+					}
+				}
+				if s.flush {
+					f.flush()
+				}
+				f.check(s.op)
+				if h := f.holeBytes(); h < s.minHoleLen {
+					t.Fatalf("step %d: %d bytes in holes, want at least %d", i, h, s.minHoleLen)
+				}
+			}
+		})
+	}
+}
+
+// Rechunking only what changed gives the chunks chunking the whole file
+// would.
+func TestRechunkMatchesFull(t *testing.T) {
+	f := newSparseFile(t)
+	f.write(0, noise(1, 200000))
+	f.flush()
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 60; i++ {
+		var off, l int
+		switch i % 4 {
+		case 0: // small overwrite
+			off, l = r.Intn(len(f.want)), 1+r.Intn(100)
+		case 1: // large overwrite
+			off, l = r.Intn(len(f.want)), 1+r.Intn(20000)
+		case 2: // append
+			off, l = len(f.want), 1+r.Intn(9000)
+		case 3: // several writes, one flush
+			f.write(r.Intn(len(f.want)), noise(int64(100+i), 10))
+			off, l = r.Intn(len(f.want)), 1+r.Intn(3000)
+		}
+		f.write(off, noise(int64(i+10), l))
+		if i%5 != 4 {
+			f.flush()
+		} else {
+			f.write(off/2, noise(int64(i+1000), 1)) // and another before flushing
+			f.flush()
+		}
+		f.check("rechunk")
+		sigs, lens := putBlocks(f.want)
+		if !reflect.DeepEqual(f.n.DataBlocks, sigs) || !reflect.DeepEqual(f.n.BlockLens, lens) {
+			k := 0
+			for k < len(sigs) && k < len(f.n.DataBlocks) && sigs[k] == f.n.DataBlocks[k] {
+				k++
+			}
+			t.Fatalf("step %d: write [%d, +%d): %d extents, a full rechunk has %d, from %d on (%v, %v) they differ", i, off, l,
+				len(f.n.DataBlocks), len(sigs), k, f.n.BlockLens[k:], lens[k:])
+		}
+	}
+}
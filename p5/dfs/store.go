@@ -0,0 +1,186 @@
+package dfs
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var ErrNotFound = errors.New("dfs: key not found")
+
+// BlockStore is the key-value store underneath the block layer. Keys are
+// either content signatures (see shaString) or metadata keys like "head".
+type BlockStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error) // ErrNotFound if missing
+	Has(key string) bool
+	Delete(key string) error
+	// Iterate calls fn for each key starting with prefix ("" for all)
+	// until fn returns false.
+	Iterate(prefix string, fn func(key string, data []byte) bool) error
+	// Keys is Iterate without the data, just its stored size, for
+	// stores where reading it is expensive.
+	Keys(prefix string, fn func(key string, size int) bool) error
+	Close() error
+}
+
+// A store path of MEMSTORE keeps everything in memory, and loses it on
+// exit: for tests, and tools embedding the package.
+const MEMSTORE = "mem:"
+
+// openStore opens the LevelDB directory dbPath, or a memStore if it's
+// MEMSTORE. There's no default: a replica without a db field would
+// otherwise lose everything it stored.
+func openStore(newfs bool, dbPath string) (BlockStore, error) {
+	if dbPath == "" {
+		return nil, errors.New("no store path (the db field in config.txt)")
+	}
+	if dbPath == MEMSTORE {
+		return NewMemStore(), nil
+	}
+	if newfs {
+		os.RemoveAll(dbPath)
+	}
+	return NewLevelStore(dbPath)
+}
+
+//=============================================================================
+// LevelDB
+
+type levelStore struct {
+	ldb *leveldb.DB
+}
+
+func NewLevelStore(dbPath string) (BlockStore, error) {
+	ldb, err := leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelStore{ldb}, nil
+}
+
+func (s *levelStore) Put(key string, data []byte) error {
+	return s.ldb.Put([]byte(key), data, nil)
+}
+
+func (s *levelStore) Get(key string) ([]byte, error) {
+	val, err := s.ldb.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
+
+func (s *levelStore) Has(key string) bool {
+	ok, err := s.ldb.Has([]byte(key), nil)
+	return ok && err == nil
+}
+
+func (s *levelStore) Delete(key string) error {
+	return s.ldb.Delete([]byte(key), nil)
+}
+
+func (s *levelStore) Iterate(prefix string, fn func(key string, data []byte) bool) error {
+	iter := s.ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		// iterator buffers are reused, hand out copies
+		val := append([]byte(nil), iter.Value()...)
+		if !fn(string(iter.Key()), val) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+func (s *levelStore) Keys(prefix string, fn func(key string, size int) bool) error {
+	iter := s.ldb.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !fn(string(iter.Key()), len(iter.Value())) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+func (s *levelStore) Close() error {
+	return s.ldb.Close()
+}
+
+//=============================================================================
+// In-memory: a store path of MEMSTORE.
+
+type memStore struct {
+	sync.RWMutex
+	m map[string][]byte
+}
+
+func NewMemStore() BlockStore {
+	return &memStore{m: make(map[string][]byte)}
+}
+
+func (s *memStore) Put(key string, data []byte) error {
+	s.Lock()
+	s.m[key] = append([]byte(nil), data...)
+	s.Unlock()
+	return nil
+}
+
+func (s *memStore) Get(key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if val, ok := s.m[key]; ok {
+		return append([]byte(nil), val...), nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Has(key string) bool {
+	s.RLock()
+	_, ok := s.m[key]
+	s.RUnlock()
+	return ok
+}
+
+func (s *memStore) Delete(key string) error {
+	s.Lock()
+	delete(s.m, key)
+	s.Unlock()
+	return nil
+}
+
+// Iterates in key order, like LevelDB. fn may call back into the store.
+func (s *memStore) Iterate(prefix string, fn func(key string, data []byte) bool) error {
+	s.RLock()
+	keys := make([]string, 0, len(s.m))
+	for k := range s.m {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	s.RUnlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if val, err := s.Get(k); err == nil && !fn(k, val) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Keys(prefix string, fn func(key string, size int) bool) error {
+	return s.Iterate(prefix, func(key string, data []byte) bool {
+		return fn(key, len(data))
+	})
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
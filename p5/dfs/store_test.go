@@ -0,0 +1,144 @@
+package dfs
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Every BlockStore should behave the same; these are run against each.
+func storeContract(t *testing.T, s BlockStore) {
+	if _, err := s.Get("missing"); err != ErrNotFound {
+		t.Fatalf("Get missing: %v, want ErrNotFound", err)
+	}
+	if s.Has("missing") {
+		t.Fatal("Has missing")
+	}
+	for _, k := range []string{"b/2", "a/1", "b/1", "head", "b/3"} {
+		if err := s.Put(k, []byte("v"+k)); err != nil {
+			t.Fatalf("Put %s: %v", k, err)
+		}
+	}
+	val, err := s.Get("b/1")
+	if err != nil || string(val) != "vb/1" {
+		t.Fatalf("Get b/1: %q %v", val, err)
+	}
+	val[0] = 'x' // callers may keep and change what they get
+	if val, _ := s.Get("b/1"); string(val) != "vb/1" {
+		t.Fatalf("Get returned the stored slice: %q", val)
+	}
+	if err := s.Put("head", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := s.Get("head"); string(val) != "new" {
+		t.Fatalf("overwritten head: %q", val)
+	}
+	if !s.Has("a/1") {
+		t.Fatal("Has a/1")
+	}
+
+	var keys []string
+	err = s.Iterate("b/", func(k string, data []byte) bool {
+		if string(data) != "v"+k {
+			t.Errorf("Iterate %s: %q", k, data)
+		}
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil || !reflect.DeepEqual(keys, []string{"b/1", "b/2", "b/3"}) {
+		t.Fatalf("Iterate b/: %v %v", keys, err)
+	}
+	keys = nil
+	s.Iterate("", func(k string, data []byte) bool {
+		keys = append(keys, k)
+		return len(keys) < 2
+	})
+	if !reflect.DeepEqual(keys, []string{"a/1", "b/1"}) {
+		t.Fatalf("Iterate stopping early: %v", keys)
+	}
+
+	sizes := make(map[string]int)
+	err = s.Keys("b/", func(k string, size int) bool {
+		sizes[k] = size
+		return true
+	})
+	if err != nil || !reflect.DeepEqual(sizes, map[string]int{"b/1": 4, "b/2": 4, "b/3": 4}) {
+		t.Fatalf("Keys b/: %v %v", sizes, err)
+	}
+
+	if err := s.Delete("b/2"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("b/2") {
+		t.Fatal("Has after Delete")
+	}
+	if _, err := s.Get("b/2"); err != ErrNotFound {
+		t.Fatalf("Get after Delete: %v", err)
+	}
+	if err := s.Delete("b/2"); err != nil {
+		t.Fatalf("Delete missing: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	storeContract(t, NewMemStore())
+}
+
+func TestLevelStore(t *testing.T) {
+	s, err := NewLevelStore(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeContract(t, s)
+}
+
+func TestOpenStoreNeedsPath(t *testing.T) {
+	if s, err := openStore(false, ""); err == nil {
+		s.Close()
+		t.Fatal("opened a store with no path")
+	}
+	s, err := openStore(true, filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*levelStore); !ok {
+		t.Fatalf("got %T", s)
+	}
+	s.Close()
+}
+
+// What Init opens: a MEMSTORE path is a fresh, empty file system each
+// time.
+func TestOpenMemStore(t *testing.T) {
+	Merep = &Replica{Pid: 1}
+	Clients = map[int]*serverConn{}
+	for i := 0; i < 2; i++ {
+		Open(false, MEMSTORE)
+		if _, ok := db.(*memStore); !ok {
+			t.Fatalf("got %T", db)
+		}
+		if len(root.ChildSigs) != 0 {
+			t.Fatal("not empty:", root.ChildSigs)
+		}
+		f := &sparseFile{t: t}
+		n, h, err := root.Create(context.Background(), &fuse.CreateRequest{Name: "f", Mode: 0644,
+			Flags: fuse.OpenReadWrite}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.n, f.h = n.(*DNode), h.(*Handle)
+		f.write(0, noise(1, 1000))
+		f.flush()
+		flushRoot()
+		f.check("mem store")
+		if _, err := db.Get("head"); err != nil {
+			t.Fatal("head not stored:", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package dfs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Targets are stored as given, whether or not they exist, and read back
+// after a flush and restart and from the history views.
+func TestSymlinkTargets(t *testing.T) {
+	testFS(t)
+	ctx := context.Background()
+	targets := map[string]string{
+		"abs":      "/etc/passwd",
+		"dangling": "../nowhere/x",
+		"long":     strings.Repeat("a/", 500) + "b",
+	}
+	for name, target := range targets {
+		if _, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: name, Target: target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "abs", Target: "x"}); err != fuse.EEXIST {
+		t.Fatal("symlink over abs:", err)
+	}
+	createFile(t, "f", []byte("not a link"))
+	restart()
+
+	readlink := func(n *DNode) (string, error) {
+		return n.Readlink(ctx, &fuse.ReadlinkRequest{})
+	}
+	for name, target := range targets {
+		l := lookup(t, root, name)
+		got, err := readlink(l)
+		if err != nil || got != target {
+			t.Fatalf("%s -> %q, %v; want %q", name, got, err, target)
+		}
+		if l.Attrs.Mode&os.ModeType != os.ModeSymlink || l.Attrs.Size != uint64(len(target)) {
+			t.Fatalf("%s: mode %v, size %d", name, l.Attrs.Mode, l.Attrs.Size)
+		}
+		vs := lookup(t, root, name+"@versions").kids
+		if len(vs) == 0 {
+			t.Fatal(name, "has no versions")
+		}
+		for _, v := range vs {
+			if got, err := readlink(v); err != nil || got != target {
+				t.Fatalf("%s: %s -> %q, %v", name, v.Name, got, err)
+			}
+		}
+	}
+	if _, err := readlink(lookup(t, root, "f")); err != fuse.Errno(syscall.EINVAL) {
+		t.Fatal("readlink of a file:", err)
+	}
+}
@@ -15,18 +15,23 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-func findDNode(n *DNode) {
+// In strong mode, gets the token before touching anything; whoever had it
+// sends us its changes first. Called without the tree lock, as those
+// arrive through Receive.
+func getToken() {
 	if ModeConsistency == "strong" && !Token {
 		p_out("\nNEED TOKEN\n")
-		for _, c := range Clients {
-			p_out("Requesting token from %d\n", n.Owner)
+		for _, c := range clients() {
+			p_out("Requesting token\n")
 			var enc_reply []byte
 			req := prepare_request("dummy", Merep.Pid)
-			c.Call("Node.ReqToken", req, &enc_reply)
+			if c.Call("Node.ReqToken", req, &enc_reply) != nil {
+				continue
+			}
 			reply := accept_response(enc_reply)
 			if reply.Ack {
 				Token = true
-				p_out("Got token from %d\n\n", n.Owner)
+				p_out("Got token\n\n")
 				break
 			}
 		}
@@ -34,11 +39,19 @@ func findDNode(n *DNode) {
 			p_out("SOMETHING BAD HAPPENED AND I DIDN'T GET THE TOKEN!\n")
 		}
 	}
+}
+
+func findDNode(n *DNode) {
+	if n == nil || n.archive {
+		return
+	}
+	meta.Lock()
 	if nd, ok := nodeMap[n.Attrs.Inode]; ok {
 		n = nd
 	} else {
 		nodeMap[n.Attrs.Inode] = n
 	}
+	meta.Unlock()
 }
 
 func p_out(s string, args ...interface{}) {
@@ -0,0 +1,104 @@
+package dfs
+
+import (
+	"sort"
+)
+
+//=============================================================================
+// Version vectors. Each DNode counts, per replica, the flushes of it that
+// replica has made: flushNode bumps our own entry. Receive compares the
+// incoming vector with ours to tell whether an update is newer (apply
+// it), older or one we've already got (ignore it), or concurrent with
+// ours: both sides changed the node since they last agreed.
+//
+// Concurrent versions are ordered the same way on every replica, so all
+// pick the same winner: the larger total count, then the larger count for
+// the lowest replica that differs. A replica that takes the other side's
+// version flushes it again, with a vector that covers both, so the others
+// converge on it. What becomes of the loser is in conflict.go.
+
+type VClock map[int]uint64
+
+// How a compares to b.
+const (
+	VV_EQUAL = iota
+	VV_NEWER
+	VV_OLDER
+	VV_CONCURRENT
+)
+
+func (a VClock) compare(b VClock) int {
+	newer, older := false, false
+	for pid, c := range a {
+		if c > b[pid] {
+			newer = true
+		}
+	}
+	for pid, c := range b {
+		if c > a[pid] {
+			older = true
+		}
+	}
+	switch {
+	case newer && older:
+		return VV_CONCURRENT
+	case newer:
+		return VV_NEWER
+	case older:
+		return VV_OLDER
+	}
+	return VV_EQUAL
+}
+
+// Whether a wins over b, concurrent with it.
+func (a VClock) wins(b VClock) bool {
+	var sa, sb uint64
+	pids := make(map[int]bool)
+	for pid, c := range a {
+		sa += c
+		pids[pid] = true
+	}
+	for pid, c := range b {
+		sb += c
+		pids[pid] = true
+	}
+	if sa != sb {
+		return sa > sb
+	}
+	var l []int
+	for pid := range pids {
+		l = append(l, pid)
+	}
+	sort.Ints(l)
+	for _, pid := range l {
+		if a[pid] != b[pid] {
+			return a[pid] > b[pid]
+		}
+	}
+	return false
+}
+
+// A new vector, with pid's count one more. Old versions of a node may
+// share its map, so it's never changed in place.
+func (a VClock) bump(pid int) VClock {
+	v := make(VClock, len(a)+1)
+	for p, c := range a {
+		v[p] = c
+	}
+	v[pid]++
+	return v
+}
+
+// The larger of each count.
+func (a VClock) merge(b VClock) VClock {
+	v := make(VClock, len(a)+len(b))
+	for p, c := range a {
+		v[p] = c
+	}
+	for p, c := range b {
+		if c > v[p] {
+			v[p] = c
+		}
+	}
+	return v
+}
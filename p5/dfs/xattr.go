@@ -0,0 +1,132 @@
+package dfs
+
+import (
+	"sort"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"golang.org/x/net/context"
+)
+
+//=============================================================================
+// Extended attributes, kept in the DNode itself so they're versioned,
+// replicated and snapshotted along with everything else. All namespaces
+// (user., security., trusted., ...) are stored alike.
+
+// setxattr(2) flags, as on Linux
+const (
+	XATTR_CREATE  = 1
+	XATTR_REPLACE = 2
+)
+
+func (n *DNode) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	who := callerOf(req.Header)
+	enter(n)
+	meta.Lock()
+	if !xattrAccess(n, who, req.Name, false) {
+		meta.Unlock()
+		leave()
+		return EACCES
+	}
+	val, ok := n.Xattrs[req.Name]
+	if !ok {
+		meta.Unlock()
+		leave()
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = append(resp.Xattr, val...)
+	meta.Unlock()
+	leave()
+	return nil
+}
+
+func (n *DNode) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	enter(n)
+	meta.Lock()
+	names := make([]string, 0, len(n.Xattrs))
+	for name := range n.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+	meta.Unlock()
+	leave()
+	return nil
+}
+
+func (n *DNode) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	who := callerOf(req.Header)
+	enter(n)
+	meta.Lock()
+	if inArchive(n) {
+		meta.Unlock()
+		leave()
+		return fuse.EPERM
+	}
+	if !xattrAccess(n, who, req.Name, true) {
+		meta.Unlock()
+		leave()
+		return EACCES
+	}
+	isACL := req.Name == ACL_XATTR || req.Name == ACL_DEFAULT_XATTR
+	if _, err := parseACL(req.Xattr); isACL && err != nil {
+		meta.Unlock()
+		leave()
+		return fuse.Errno(syscall.EINVAL)
+	}
+	_, ok := n.Xattrs[req.Name]
+	if ok && req.Flags&XATTR_CREATE != 0 {
+		meta.Unlock()
+		leave()
+		return fuse.EEXIST
+	}
+	if !ok && req.Flags&XATTR_REPLACE != 0 {
+		meta.Unlock()
+		leave()
+		return fuse.ErrNoXattr
+	}
+	if n.Xattrs == nil {
+		n.Xattrs = make(map[string][]byte)
+	}
+	n.Xattrs[req.Name] = append([]byte(nil), req.Xattr...)
+	if req.Name == ACL_XATTR {
+		n.syncACL(false)
+	}
+	n.Attrs.Ctime = time.Now()
+	markDirty(n)
+	meta.Unlock()
+	leave()
+	return nil
+}
+
+func (n *DNode) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	who := callerOf(req.Header)
+	enter(n)
+	meta.Lock()
+	if inArchive(n) {
+		meta.Unlock()
+		leave()
+		return fuse.EPERM
+	}
+	if !xattrAccess(n, who, req.Name, true) {
+		meta.Unlock()
+		leave()
+		return EACCES
+	}
+	if _, ok := n.Xattrs[req.Name]; !ok {
+		meta.Unlock()
+		leave()
+		return fuse.ErrNoXattr
+	}
+	delete(n.Xattrs, req.Name)
+	if len(n.Xattrs) == 0 {
+		n.Xattrs = nil
+	}
+	n.Attrs.Ctime = time.Now()
+	markDirty(n)
+	meta.Unlock()
+	leave()
+	return nil
+}
@@ -0,0 +1,62 @@
+package dfs
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// What the file system itself returns; the caller's buffer size is
+// checked by fuse's serve loop.
+func TestXattrValues(t *testing.T) {
+	f := newSparseFile(t)
+	ctx := context.Background()
+	set := func(name, val string, flags uint32) error {
+		return f.n.Setxattr(ctx, &fuse.SetxattrRequest{Name: name, Xattr: []byte(val), Flags: flags})
+	}
+	get := func(name string) (string, error) {
+		resp := &fuse.GetxattrResponse{}
+		err := f.n.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, resp)
+		return string(resp.Xattr), err
+	}
+	for name, val := range map[string]string{"user.empty": "", "user.a": "0123456789"} {
+		if err := set(name, val, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set("user.a", "x", XATTR_CREATE); err != fuse.EEXIST {
+		t.Fatal("create over user.a:", err)
+	}
+	if err := set("user.none", "x", XATTR_REPLACE); err != fuse.ErrNoXattr {
+		t.Fatal("replace user.none:", err)
+	}
+	f.flush()
+	flushRoot()
+	restart()
+	f.n = lookup(t, root, "f")
+
+	for name, want := range map[string]string{"user.empty": "", "user.a": "0123456789"} {
+		if val, err := get(name); err != nil || val != want {
+			t.Fatalf("%s: %q, %v; want %q", name, val, err, want)
+		}
+	}
+	if _, err := get("user.none"); err != fuse.ErrNoXattr { // ENODATA on Linux
+		t.Fatal("missing attribute:", err)
+	}
+	list := &fuse.ListxattrResponse{}
+	if err := f.n.Listxattr(ctx, &fuse.ListxattrRequest{}, list); err != nil ||
+		string(list.Xattr) != "user.a\x00user.empty\x00" {
+		t.Fatalf("list: %q, %v", list.Xattr, err)
+	}
+
+	if err := f.n.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.empty"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.n.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.none"}); err != fuse.ErrNoXattr {
+		t.Fatal("remove user.none:", err)
+	}
+	if _, err := get("user.empty"); err != fuse.ErrNoXattr {
+		t.Fatal("removed attribute:", err)
+	}
+}
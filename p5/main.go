@@ -21,33 +21,68 @@ func main() {
 	var c int
 
 	for {
-		if c = Getopt("ndta:f:m:r:"); c == EOF {
+		if c = Getopt("ndta:c:e:f:k:m:r:S:w:"); c == EOF {
 			break
 		}
 
 		switch c {
 		case 'n':
 			newfs = "NEWFS "
+		case 'c':
+			if !dfs.ValidCodec(OptArg) {
+				fmt.Printf("unknown codec %q\n", OptArg)
+				os.Exit(1)
+			}
+			dfs.Compress = OptArg
 		case 'd':
 			dfs.Debug = !dfs.Debug
+		case 'e':
+			dfs.SyncPeriod, _ = strconv.Atoi(OptArg)
 		case 'f':
 			dfs.FlusherPeriod, _ = strconv.Atoi(OptArg)
+		case 'k':
+			if _, err := dfs.ParseChunkParams(OptArg); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			dfs.ChunkSpec = OptArg
 		case 't':
 			dfs.Token = true
 		case 'm':
 			dfs.ModeConsistency = OptArg
 		case 'r':
 			replicaString = OptArg
+		case 'S':
+			dfs.MountSnapshot = OptArg
+		case 'w':
+			dfs.WriteQuorum, _ = strconv.Atoi(OptArg)
 		case 'a':
 			first = false
 			auth = OptArg
 		default:
-			println("usage: main.go [-n | -d | -f <flush dur> | -m <mode> | -r <rep string>]", c)
+			println("usage: main.go [-n | -d | -c <codec> | -e <sync dur> | -f <flush dur> | -k <chunker> | -m <mode> | -r <rep string> | -S <snapshot> | -w <quorum>] [command]", c)
+			os.Exit(1)
+		}
+	}
+
+	// e.g. "main.go -r local1 stats"
+	if args := os.Args[OptInd:]; len(args) > 0 {
+		dfs.LoadConfig(replicaString, "config.txt")
+		if err := dfs.RunCommand(dfs.Merep.Db, args); err != nil {
+			fmt.Printf("%v\n", err)
 			os.Exit(1)
 		}
+		os.Exit(0)
+	}
+	// a snapshot is mounted read-only, on its own, outside the replica set
+	if dfs.MountSnapshot != "" {
+		dfs.LoadConfig(replicaString, "config.txt")
+		fmt.Printf("\nmounting snapshot %q of %q at %q\n\n", dfs.MountSnapshot, dfs.Merep.Db, dfs.Merep.Mount)
+		dfs.Init(dfs.Merep.Mount, false, dfs.Merep.Db)
+		os.Exit(0)
 	}
-	fmt.Printf("\nStartup up with debug %v, flush period %v, %smode: %q, replicaStr  %q token: %t\n\n",
-		dfs.Debug, dfs.FlusherPeriod, newfs, dfs.ModeConsistency, replicaString, dfs.Token)
+	fmt.Printf("\nStartup up with debug %v, flush period %v, %smode: %q, replicaStr  %q token: %t compress: %s quorum: %d sync: %d\n\n",
+		dfs.Debug, dfs.FlusherPeriod, newfs, dfs.ModeConsistency, replicaString, dfs.Token, dfs.Compress, dfs.WriteQuorum, dfs.SyncPeriod)
 
 	if first {
 		dfs.AESkey = make([]byte, aes.BlockSize)
@@ -55,6 +90,7 @@ func main() {
 		fmt.Printf("session key: [%s]\n", dfs.AESkey)
 	}
 	dfs.LoadConfig(replicaString, "config.txt")
+	joinVia := -1
 	for _, r := range dfs.Replicas {
 		if r != dfs.Merep {
 			fmt.Printf("client r: %q\n", r)
@@ -82,9 +118,17 @@ func main() {
 					fmt.Printf("Incorrect nonce!\n")
 					os.Exit(0)
 				}
+				joinVia = r.Pid
 			}
 		}
 	}
+	// join the cluster through whoever we authenticated with
+	if joinVia >= 0 {
+		if err := dfs.Join(joinVia); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
 	go func() {
 		dfs.ServeInterface(dfs.Merep.Addr, dfs.Merep.Port, new(dfs.Node))
 		fmt.Printf("\nDebug %v, mountpt: %q, %sstorePath %q, at %s:%d\n\n",